@@ -0,0 +1,322 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ziyan/gatewaysshd/gateway"
+)
+
+var (
+	ErrUnauthorized = errors.New("401: unauthorized")
+	ErrForbidden    = errors.New("403: forbidden")
+)
+
+const (
+	// how far the timestamp of a ssh signed request may be off
+	signedRequestMaxSkew = 5 * time.Minute
+
+	// largest request body that is hashed for a ssh signed request
+	signedRequestMaxBody = 1 << 20
+)
+
+// who is making a http request, with the same role model as ssh sessions
+type identity struct {
+	user  string
+	admin bool
+}
+
+// whether the identity may access data of the user
+func (i *identity) canAccess(user string) bool {
+	return i.admin || i.user == user
+}
+
+// authenticates http requests by bearer token, tls client certificate or ssh signature
+type httpAuthenticator struct {
+	gateway        *gateway.Gateway
+	tokens         map[string]*identity
+	tokenSecret    []byte
+	allowAnonymous bool
+
+	// nonces of ssh signed requests seen within the skew window, keyed by key fingerprint
+	nonces     map[string]time.Time
+	noncesLock *sync.Mutex
+}
+
+func newHTTPAuthenticator(gateway *gateway.Gateway, tokensFile, tokenSecret string, allowAnonymous bool) (*httpAuthenticator, error) {
+	tokens := make(map[string]*identity)
+	if tokensFile != "" {
+		var err error
+		if tokens, err = loadTokens(tokensFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &httpAuthenticator{
+		gateway:        gateway,
+		tokens:         tokens,
+		tokenSecret:    []byte(tokenSecret),
+		allowAnonymous: allowAnonymous,
+		nonces:         make(map[string]time.Time),
+		noncesLock:     &sync.Mutex{},
+	}, nil
+}
+
+// load a file with one "<token> <user> [admin]" entry per line
+func loadTokens(filename string) (map[string]*identity, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := make(map[string]*identity)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "admin") {
+			return nil, fmt.Errorf("%s:%d: expected \"<token> <user> [admin]\"", filename, number)
+		}
+		tokens[fields[0]] = &identity{
+			user:  fields[1],
+			admin: len(fields) == 3,
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (a *httpAuthenticator) authenticate(request *http.Request) (*identity, error) {
+	// tls client certificate verified against the client ca
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 && len(request.TLS.VerifiedChains[0]) > 0 {
+		certificate := request.TLS.VerifiedChains[0][0]
+		admin := false
+		for _, unit := range certificate.Subject.OrganizationalUnit {
+			if unit == "admin" {
+				admin = true
+			}
+		}
+		return &identity{
+			user:  certificate.Subject.CommonName,
+			admin: admin,
+		}, nil
+	}
+
+	authorization := request.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(authorization, "Bearer "):
+		return a.authenticateToken(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")))
+	case strings.HasPrefix(authorization, "SSH-Signature "):
+		return a.authenticateSignature(request, strings.TrimPrefix(authorization, "SSH-Signature "))
+	case authorization == "" && a.allowAnonymous:
+		return &identity{
+			admin: true,
+		}, nil
+	}
+	return nil, ErrUnauthorized
+}
+
+func (a *httpAuthenticator) authenticateToken(token string) (*identity, error) {
+	for configured, identity := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(configured), []byte(token)) == 1 {
+			return identity, nil
+		}
+	}
+
+	if len(a.tokenSecret) > 0 {
+		if identity, err := verifySignedToken(a.tokenSecret, token); err == nil {
+			return identity, nil
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+// the claims carried in a signed token
+type tokenClaims struct {
+	User    string `json:"user"`
+	Admin   bool   `json:"admin,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// issue a token of the form <claims>.<hmac-sha256 of claims>, both base64 encoded
+func issueSignedToken(secret []byte, user string, admin bool, validity time.Duration) (string, error) {
+	claims, err := json.Marshal(&tokenClaims{
+		User:    user,
+		Admin:   admin,
+		Expires: time.Now().Add(validity).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifySignedToken(secret []byte, token string) (*identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrUnauthorized
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrUnauthorized
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, ErrUnauthorized
+	}
+	if claims.User == "" || time.Now().Unix() > claims.Expires {
+		return nil, ErrUnauthorized
+	}
+
+	return &identity{
+		user:  claims.User,
+		admin: claims.Admin,
+	}, nil
+}
+
+// authenticate a request signed with a key or certificate that can log in over ssh,
+// the header carries user, key, timestamp, nonce and signature parameters, where the signature is over
+// "gatewaysshd\n<method>\n<host>\n<request uri>\n<user>\n<timestamp>\n<nonce>\n<hex sha256 of body>"
+func (a *httpAuthenticator) authenticateSignature(request *http.Request, header string) (*identity, error) {
+	parameters := make(map[string]string)
+	for _, parameter := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(parameter), "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrUnauthorized
+		}
+		parameters[parts[0]] = strings.Trim(parts[1], "\"")
+	}
+
+	timestamp, err := strconv.ParseInt(parameters["timestamp"], 10, 64)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > signedRequestMaxSkew || skew < -signedRequestMaxSkew {
+		return nil, ErrUnauthorized
+	}
+	nonce := parameters["nonce"]
+	if nonce == "" {
+		return nil, ErrUnauthorized
+	}
+
+	rawKey, err := base64.StdEncoding.DecodeString(parameters["key"])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	key, err := ssh.ParsePublicKey(rawKey)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	rawSignature, err := base64.StdEncoding.DecodeString(parameters["signature"])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(rawSignature, signature); err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	bodyHash, err := hashRequestBody(request)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	data := fmt.Sprintf("gatewaysshd\n%s\n%s\n%s\n%s\n%d\n%s\n%s", request.Method, request.Host, request.URL.RequestURI(), parameters["user"], timestamp, nonce, bodyHash)
+	if err := key.Verify([]byte(data), signature); err != nil {
+		return nil, ErrUnauthorized
+	}
+	if !a.useNonce(ssh.FingerprintSHA256(key)+"/"+nonce, time.Unix(timestamp, 0)) {
+		log.Warningf("http: ssh signature replayed: user = %s, remote = %s", parameters["user"], request.RemoteAddr)
+		return nil, ErrUnauthorized
+	}
+
+	remoteAddr, err := net.ResolveTCPAddr("tcp", request.RemoteAddr)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	admin, err := a.gateway.AuthenticatePublicKey(parameters["user"], remoteAddr, key)
+	if err != nil {
+		log.Warningf("http: ssh signature rejected: user = %s, remote = %s, error = %s", parameters["user"], request.RemoteAddr, err)
+		return nil, ErrUnauthorized
+	}
+
+	return &identity{
+		user:  parameters["user"],
+		admin: admin,
+	}, nil
+}
+
+// hex sha256 of the request body, which is read in full and put back for the handler
+func hashRequestBody(request *http.Request) (string, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(request.Body, signedRequestMaxBody+1)); err != nil {
+			return "", err
+		}
+		if len(body) > signedRequestMaxBody {
+			return "", ErrUnauthorized
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// record a nonce of a signed request, returns false if it was already used within the skew window
+func (a *httpAuthenticator) useNonce(nonce string, timestamp time.Time) bool {
+	a.noncesLock.Lock()
+	defer a.noncesLock.Unlock()
+
+	now := time.Now()
+	for used, expires := range a.nonces {
+		if now.After(expires) {
+			delete(a.nonces, used)
+		}
+	}
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+	// the timestamp is accepted until skew after it, so the nonce must be kept at least that long
+	a.nonces[nonce] = timestamp.Add(signedRequestMaxSkew)
+	return true
+}
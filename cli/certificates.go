@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ziyan/gatewaysshd/gateway"
+)
+
+// the body of a request to create a certificate token
+type certificateTokenRequest struct {
+	Principal string `json:"principal"`
+	Admin     bool   `json:"admin"`
+
+	// how long the token is valid, such as "24h"
+	Validity string `json:"validity"`
+
+	// how long the issued certificate is valid, such as "168h", defaults to the configured validity
+	CertificateValidity string `json:"certificate_validity"`
+}
+
+type certificatesResponse struct {
+	Certificates []*gateway.IssuedCertificateInfo `json:"certificates"`
+	Meta         *listMeta                        `json:"meta"`
+}
+
+// list the certificates issued by the gateway, optionally of a principal
+func listCertificates(g *gateway.Gateway, request *http.Request, identity *identity) (interface{}, error) {
+	if !identity.admin {
+		return nil, ErrForbidden
+	}
+	if request.Method != http.MethodGet {
+		return nil, ErrMethodNotAllowed
+	}
+
+	certificates, err := g.ListCertificates(request.URL.Query().Get("principal"))
+	if err != nil {
+		return nil, err
+	}
+	return &certificatesResponse{
+		Certificates: certificates,
+		Meta: &listMeta{
+			TotalCount: len(certificates),
+		},
+	}, nil
+}
+
+func handleCertificateTokens(g *gateway.Gateway, request *http.Request, identity *identity) (interface{}, error) {
+	if !identity.admin {
+		return nil, ErrForbidden
+	}
+	if request.Method != http.MethodPost {
+		return nil, ErrMethodNotAllowed
+	}
+
+	var body certificateTokenRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil || body.Principal == "" {
+		return nil, ErrBadRequest
+	}
+
+	var err error
+	validity := 24 * time.Hour
+	if body.Validity != "" {
+		if validity, err = time.ParseDuration(body.Validity); err != nil {
+			return nil, ErrBadRequest
+		}
+	}
+	options := &gateway.CertificateOptions{
+		Admin: body.Admin,
+	}
+	if body.CertificateValidity != "" {
+		if options.Validity, err = time.ParseDuration(body.CertificateValidity); err != nil {
+			return nil, ErrBadRequest
+		}
+	}
+
+	token, err := g.CreateCertificateToken(body.Principal, validity, options)
+	if err == gateway.ErrNoSigningKey {
+		return nil, ErrBadRequest
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tokenResponse{
+		Token: token,
+	}, nil
+}
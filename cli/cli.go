@@ -1,25 +1,32 @@
 package cli
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/ziyan/gatewaysshd/gateway"
 )
 
 var log = logging.MustGetLogger("cli")
 
+var (
+	ErrMissingArgument = errors.New("gatewaysshd: missing argument")
+	ErrNotLoopback     = errors.New("gatewaysshd: pprof listener must be bound to a loopback address")
+)
+
 func configureLogging(level, format string) {
 	logging.SetBackend(logging.NewBackendFormatter(
 		logging.NewLogBackend(os.Stderr, "", 0),
@@ -31,6 +38,46 @@ func configureLogging(level, format string) {
 	log.Debugf("log level set to %s", logging.GetLevel(""))
 }
 
+// read and concatenate files, one per line, or the default file when none are given
+func readFiles(filenames []string, defaultFilename string) ([]byte, error) {
+	if len(filenames) == 0 {
+		filenames = []string{defaultFilename}
+	}
+
+	var contents []byte
+	for _, filename := range filenames {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(append(contents, content...), '\n')
+	}
+	return contents, nil
+}
+
+// parse the certificate policy file, no file means the default policy
+func loadCertificatePolicy(filename string) (*gateway.CertificatePolicy, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return gateway.ParseCertificatePolicy(data)
+}
+
+func loadAccessPolicy(filename string) (*gateway.AccessPolicy, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return gateway.ParseAccessPolicy(data)
+}
+
 func Run(args []string) {
 
 	app := cli.NewApp()
@@ -40,6 +87,11 @@ func Run(args []string) {
 	app.Usage = "A daemon that provides a meeting place for all your SSH tunnels."
 
 	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "path to a yaml config file setting flags by name and policies in sections, flags and environment variables take precedence",
+		},
 		&cli.StringFlag{
 			Name:  "log-level",
 			Value: "INFO",
@@ -65,15 +117,13 @@ func Run(args []string) {
 			Value: "id_rsa.ca.pub",
 			Usage: "path to certificate authority public key",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:  "host-certificate",
-			Value: "id_rsa.host-cert.pub",
-			Usage: "path to host certificate",
+			Usage: "path to host certificate, can be repeated, the first of each key type is used and all are announced to clients, defaults to id_rsa.host-cert.pub",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:  "host-private-key",
-			Value: "id_rsa.host",
-			Usage: "path to host private key",
+			Usage: "path to host private key, can be repeated, defaults to id_rsa.host",
 		},
 		&cli.StringFlag{
 			Name:  "server-version",
@@ -85,27 +135,202 @@ func Run(args []string) {
 			Value: "crl.txt",
 			Usage: "a file containing one certificate key id per line for revoked certificates",
 		},
+		&cli.BoolFlag{
+			Name:  "enrollment",
+			Usage: "let devices enroll their public key by logging in as the enroll user with a one-time token",
+		},
+		&cli.StringFlag{
+			Name:  "ca-policy",
+			Value: "",
+			Usage: "path to a yaml file of what certificates signed by each certificate authority may do, by default only the first one passes down permissions",
+		},
+		&cli.StringFlag{
+			Name:  "ca-private-key",
+			Value: "",
+			Usage: "path to a certificate authority private key to issue certificates to enrolling devices",
+		},
+		&cli.StringFlag{
+			Name:  "certificate-validity",
+			Value: "168h",
+			Usage: "how long certificates issued to enrolling devices are valid",
+		},
+		&cli.StringSliceFlag{
+			Name:  "certificate-extension",
+			Usage: "extension of issued certificates as name or name=value, can be repeated, defaults to permit-pty",
+		},
+		&cli.StringFlag{
+			Name:  "renewal-window",
+			Value: "72h",
+			Usage: "how long before expiry certificates can be renewed, and connections are warned about them",
+		},
+		&cli.StringFlag{
+			Name:  "auth-socket",
+			Value: "",
+			Usage: "path to a unix socket of a helper that is asked about keys not signed by the certificate authority",
+		},
+		&cli.StringFlag{
+			Name:  "auth-socket-timeout",
+			Value: "5s",
+			Usage: "timeout of each request to the authentication helper",
+		},
+		&cli.StringFlag{
+			Name:  "access-policy",
+			Value: "",
+			Usage: "path to a yaml file of rules allowing or denying connections by network, country or asn, optionally per user",
+		},
+		&cli.IntFlag{
+			Name:  "ban-failures",
+			Value: 0,
+			Usage: "ban an ip address after this many failed logins within the ban window, 0 disables",
+		},
+		&cli.IntFlag{
+			Name:  "ban-prefix-failures",
+			Value: 0,
+			Usage: "ban a /24 or /64 prefix after this many failed logins of its addresses within the ban window, 0 disables",
+		},
+		&cli.StringFlag{
+			Name:  "ban-window",
+			Value: "10m",
+			Usage: "how long failed authentications are counted",
+		},
+		&cli.StringFlag{
+			Name:  "ban-duration",
+			Value: "1h",
+			Usage: "how long addresses are banned",
+		},
+		&cli.BoolFlag{
+			Name:  "ban-persist",
+			Usage: "store bans in the database so that they last across restarts",
+		},
 		&cli.StringFlag{
 			Name:  "idle-timeout",
 			Value: "600s",
 			Usage: "idle timeout",
 		},
+		&cli.StringFlag{
+			Name:  "drain-timeout",
+			Value: "30s",
+			Usage: "how long open tunnels may finish after SIGINT or SIGTERM before all connections are closed",
+		},
 		&cli.StringFlag{
 			Name:  "geoip-database",
 			Value: "geoip.mmdb",
 			Usage: "path to the geoip database file",
 		},
+		&cli.StringFlag{
+			Name:  "asn-database",
+			Value: "",
+			Usage: "path to a geoip asn or isp database file, adds the asn, organization and isp to locations, and is needed by access rules on asns",
+		},
+		&cli.StringFlag{
+			Name:  "connection-type-database",
+			Value: "",
+			Usage: "path to a geoip connection type database file, adds the connection type to locations",
+		},
 		&cli.StringFlag{
 			Name:  "database",
 			Value: "database.db",
 			Usage: "path to database file",
 		},
+		&cli.BoolFlag{
+			Name:  "allow-legacy-status",
+			Usage: "accept unknown commands that are valid json as status reports",
+		},
+		&cli.StringFlag{
+			Name:  "http-tls-cert",
+			Value: "",
+			Usage: "path to the certificate to serve http over tls, reloaded when changed",
+		},
+		&cli.StringFlag{
+			Name:  "http-tls-key",
+			Value: "",
+			Usage: "path to the private key to serve http over tls, reloaded when changed",
+		},
+		&cli.StringFlag{
+			Name:  "http-tls-client-ca",
+			Value: "",
+			Usage: "path to a certificate authority used to verify optional tls client certificates",
+		},
+		&cli.StringFlag{
+			Name:  "http-tokens",
+			Value: "",
+			Usage: "a file containing one \"<token> <user> [admin]\" per line for http api bearer tokens",
+		},
+		&cli.StringFlag{
+			Name:  "http-token-secret",
+			Value: "",
+			Usage: "secret to verify signed http api bearer tokens issued by the token command",
+		},
+		&cli.BoolFlag{
+			Name:  "http-allow-anonymous",
+			Usage: "allow unauthenticated admin access to the http api",
+		},
+		&cli.BoolFlag{
+			Name:  "metrics-per-user",
+			Usage: "label connection and traffic metrics by user",
+		},
+		&cli.StringSliceFlag{
+			Name:  "webhook-url",
+			Usage: "url to post lifecycle events to, can be repeated",
+		},
+		&cli.StringSliceFlag{
+			Name:  "webhook-event",
+			Usage: "glob pattern of event types to post to webhooks, can be repeated, defaults to all",
+		},
+		&cli.StringSliceFlag{
+			Name:  "webhook-user",
+			Usage: "glob pattern of users whose events are posted to webhooks, can be repeated, defaults to all",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-secret",
+			Value: "",
+			Usage: "secret used to sign webhook requests with hmac-sha256",
+		},
+		&cli.IntFlag{
+			Name:  "webhook-queue-size",
+			Value: 1024,
+			Usage: "number of events queued per webhook before events are dropped",
+		},
+		&cli.IntFlag{
+			Name:  "webhook-retries",
+			Value: 5,
+			Usage: "number of times a failed webhook delivery is retried",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-timeout",
+			Value: "10s",
+			Usage: "timeout of each webhook delivery attempt",
+		},
 		&cli.BoolFlag{
 			Name:  "debug-pprof",
-			Usage: "enable pprof debugging",
+			Usage: "enable pprof debugging on the http listener for admins",
+		},
+		&cli.StringFlag{
+			Name:  "listen-pprof",
+			Value: "",
+			Usage: "separate unauthenticated pprof listen endpoint, must be a loopback address",
 		},
 	}
 
+	// every flag can also be set by an environment variable, such as GATEWAYSSHD_LISTEN_SSH,
+	// and then by the config file
+	setEnvVars(app.Flags)
+	app.Before = func(c *cli.Context) error {
+		if c.String("config") == "" {
+			return nil
+		}
+		config, err := loadConfig(c.String("config"), app.Flags)
+		if err != nil {
+			log.Errorf("failed to load config file \"%s\": %s", c.String("config"), err)
+			return err
+		}
+		if err := config.apply(c, app.Flags); err != nil {
+			log.Errorf("failed to apply config file \"%s\": %s", c.String("config"), err)
+			return err
+		}
+		return nil
+	}
+
 	app.Action = func(c *cli.Context) error {
 		configureLogging(c.String("log-level"), c.String("log-format"))
 
@@ -116,15 +341,15 @@ func Run(args []string) {
 			return err
 		}
 
-		hostCertificate, err := ioutil.ReadFile(c.String("host-certificate"))
+		hostCertificate, err := readFiles(c.StringSlice("host-certificate"), "id_rsa.host-cert.pub")
 		if err != nil {
-			log.Errorf("failed to load host certificate from file \"%s\": %s", c.String("certificate"), err)
+			log.Errorf("failed to load host certificate: %s", err)
 			return err
 		}
 
-		hostPrivateKey, err := ioutil.ReadFile(c.String("host-private-key"))
+		hostPrivateKey, err := readFiles(c.StringSlice("host-private-key"), "id_rsa.host")
 		if err != nil {
-			log.Errorf("failed to load host private key from file \"%s\": %s", c.String("host-private-key"), err)
+			log.Errorf("failed to load host private key: %s", err)
 			return err
 		}
 
@@ -134,6 +359,96 @@ func Run(args []string) {
 			return err
 		}
 
+		drainTimeout, err := time.ParseDuration(c.String("drain-timeout"))
+		if err != nil {
+			log.Errorf("failed to parse drain timeout \"%s\": %s", c.String("drain-timeout"), err)
+			return err
+		}
+
+		webhookTimeout, err := time.ParseDuration(c.String("webhook-timeout"))
+		if err != nil {
+			log.Errorf("failed to parse webhook timeout \"%s\": %s", c.String("webhook-timeout"), err)
+			return err
+		}
+
+		var webhooks []*gateway.WebhookSettings
+		for _, url := range c.StringSlice("webhook-url") {
+			webhooks = append(webhooks, &gateway.WebhookSettings{
+				URL:        url,
+				Types:      c.StringSlice("webhook-event"),
+				Users:      c.StringSlice("webhook-user"),
+				Secret:     c.String("webhook-secret"),
+				QueueSize:  c.Int("webhook-queue-size"),
+				MaxRetries: c.Int("webhook-retries"),
+				Timeout:    webhookTimeout,
+			})
+		}
+		config, err := currentConfig(c, app.Flags)
+		if err != nil {
+			log.Errorf("failed to load config file \"%s\": %s", c.String("config"), err)
+			return err
+		}
+		webhooks = append(webhooks, config.webhooks(c, webhookTimeout)...)
+
+		// the signing key of issued certificates
+		var signingKey ssh.Signer
+		if c.String("ca-private-key") != "" {
+			caPrivateKey, err := ioutil.ReadFile(c.String("ca-private-key"))
+			if err != nil {
+				log.Errorf("failed to load certificate authority private key from file \"%s\": %s", c.String("ca-private-key"), err)
+				return err
+			}
+			if signingKey, err = ssh.ParsePrivateKey(caPrivateKey); err != nil {
+				log.Errorf("failed to parse certificate authority private key: %s", err)
+				return err
+			}
+		}
+
+		certificateValidity, err := time.ParseDuration(c.String("certificate-validity"))
+		if err != nil {
+			log.Errorf("failed to parse certificate validity \"%s\": %s", c.String("certificate-validity"), err)
+			return err
+		}
+
+		renewalWindow, err := time.ParseDuration(c.String("renewal-window"))
+		if err != nil {
+			log.Errorf("failed to parse renewal window \"%s\": %s", c.String("renewal-window"), err)
+			return err
+		}
+
+		var certificateExtensions map[string]string
+		if len(c.StringSlice("certificate-extension")) > 0 {
+			certificateExtensions = make(map[string]string)
+			for _, extension := range c.StringSlice("certificate-extension") {
+				name, value := extension, ""
+				if i := strings.Index(extension, "="); i >= 0 {
+					name, value = extension[:i], extension[i+1:]
+				}
+				certificateExtensions[name] = value
+			}
+		}
+
+		var bans *gateway.BanSettings
+		if c.Int("ban-failures") > 0 || c.Int("ban-prefix-failures") > 0 {
+			banWindow, err := time.ParseDuration(c.String("ban-window"))
+			if err != nil {
+				log.Errorf("failed to parse ban window \"%s\": %s", c.String("ban-window"), err)
+				return err
+			}
+			banDuration, err := time.ParseDuration(c.String("ban-duration"))
+			if err != nil {
+				log.Errorf("failed to parse ban duration \"%s\": %s", c.String("ban-duration"), err)
+				return err
+			}
+			bans = &gateway.BanSettings{
+				MaxFailures:       c.Int("ban-failures"),
+				MaxPrefixFailures: c.Int("ban-prefix-failures"),
+				Window:            banWindow,
+				Duration:          banDuration,
+				Persist:           c.Bool("ban-persist"),
+			}
+		}
+
 		// open database
 		database, err := gateway.OpenDatabase(c.String("database"))
 		if err != nil {
@@ -142,14 +457,75 @@ func Run(args []string) {
 		}
 		defer database.Close()
 
+		// certificates and keys in the database are accepted first, then the helper is asked
+		var authenticators []gateway.Authenticator
+		if c.String("auth-socket") != "" {
+			authSocketTimeout, err := time.ParseDuration(c.String("auth-socket-timeout"))
+			if err != nil {
+				log.Errorf("failed to parse authentication helper timeout \"%s\": %s", c.String("auth-socket-timeout"), err)
+				return err
+			}
+			authenticators = append(authenticators, gateway.NewUnixSocketAuthenticator(c.String("auth-socket"), authSocketTimeout))
+		}
+
+		policy, accessPolicy, err := loadPolicies(c, app.Flags)
+		if err != nil {
+			log.Errorf("failed to load policies: %s", err)
+			return err
+		}
+
 		// create gateway
-		gateway, err := gateway.NewGateway(c.String("server-version"), caPublicKey, hostCertificate, hostPrivateKey, c.String("revocation-list"), c.String("geoip-database"), database)
+		settings := &gateway.Settings{
+			AllowLegacyStatus: c.Bool("allow-legacy-status"),
+			Webhooks:          webhooks,
+			MetricsPerUser:    c.Bool("metrics-per-user"),
+			Authenticators:    authenticators,
+			CertificatePolicy: policy,
+			Enrollment:        c.Bool("enrollment"),
+
+			SigningKey:            signingKey,
+			CertificateValidity:   certificateValidity,
+			CertificateExtensions: certificateExtensions,
+			RenewalWindow:         renewalWindow,
+
+			AccessPolicy:           accessPolicy,
+			ASNDatabase:            c.String("asn-database"),
+			ConnectionTypeDatabase: c.String("connection-type-database"),
+			Bans:                   bans,
+		}
+		gateway, err := gateway.NewGateway(c.String("server-version"), caPublicKey, hostCertificate, hostPrivateKey, c.String("revocation-list"), c.String("geoip-database"), database, settings)
 		if err != nil {
 			log.Errorf("failed to create ssh gateway: %s", err)
 			return err
 		}
 		defer gateway.Close()
 
+		// re-read keys and certificates on sighup or the reload command
+		settings.ReloadFunc = func() error {
+			caPublicKey, err := ioutil.ReadFile(c.String("ca-public-key"))
+			if err != nil {
+				return err
+			}
+			hostCertificate, err := readFiles(c.StringSlice("host-certificate"), "id_rsa.host-cert.pub")
+			if err != nil {
+				return err
+			}
+			hostPrivateKey, err := readFiles(c.StringSlice("host-private-key"), "id_rsa.host")
+			if err != nil {
+				return err
+			}
+			policy, accessPolicy, err := loadPolicies(c, app.Flags)
+			if err != nil {
+				return err
+			}
+			if err := gateway.Reload(caPublicKey, hostCertificate, hostPrivateKey); err != nil {
+				return err
+			}
+			gateway.SetCertificatePolicy(policy)
+			gateway.SetAccessPolicy(accessPolicy)
+			return nil
+		}
+
 		// listen
 		log.Noticef("listening for ssh connection on %s", c.String("listen-ssh"))
 		listener, err := net.Listen("tcp", c.String("listen-ssh"))
@@ -157,14 +533,19 @@ func Run(args []string) {
 			log.Errorf("failed to listen on \"%s\": %s", c.String("listen-ssh"), err)
 			return err
 		}
-		defer func() {
-			if err := listener.Close(); err != nil {
-				log.Warningf("failed to close listener: %s", err)
-			}
-		}()
+		var listenerOnce sync.Once
+		closeListener := func() {
+			listenerOnce.Do(func() {
+				if err := listener.Close(); err != nil {
+					log.Warningf("failed to close listener: %s", err)
+				}
+			})
+		}
+		defer closeListener()
 
 		// signal to quit
 		quit := false
+		shutdown := false
 
 		// accept all connections
 		sshing := make(chan struct{})
@@ -186,93 +567,189 @@ func Run(args []string) {
 		// serve http
 		httping := make(chan struct{})
 		if c.String("listen-http") != "" {
-			go func() {
-				defer close(httping)
+			auth, err := newHTTPAuthenticator(gateway, c.String("http-tokens"), c.String("http-token-secret"), c.Bool("http-allow-anonymous"))
+			if err != nil {
+				log.Errorf("failed to load http api tokens: %s", err)
+				return err
+			}
+			if c.Bool("http-allow-anonymous") {
+				log.Warningf("http api allows unauthenticated admin access")
+			}
 
-				ErrNotFound := errors.New("404: not found")
-
-				wrapHandler := func(handler func(*http.Request) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
-					return func(response http.ResponseWriter, request *http.Request) {
-						result, err := handler(request)
-						if err != nil {
-							if err == ErrNotFound {
-								http.NotFound(response, request)
-								return
-							}
-							log.Errorf("failed to handle request: %s", err)
-							http.Error(response, "500 internal server error", http.StatusInternalServerError)
-							return
-						}
+			server := &http.Server{
+				Addr:    c.String("listen-http"),
+				Handler: newHTTPHandler(gateway, auth, c.Bool("debug-pprof")),
+			}
+			if c.String("http-tls-cert") != "" || c.String("http-tls-key") != "" {
+				if c.String("http-tls-cert") == "" || c.String("http-tls-key") == "" {
+					log.Errorf("both --http-tls-cert and --http-tls-key are required to serve http over tls")
+					return ErrMissingArgument
+				}
+				reloader, err := newTLSReloader(c.String("http-tls-cert"), c.String("http-tls-key"), c.String("http-tls-client-ca"))
+				if err != nil {
+					log.Errorf("failed to load http tls certificate: %s", err)
+					return err
+				}
+				server.TLSConfig = reloader.serverConfig()
+			} else if c.String("http-tls-client-ca") != "" {
+				log.Errorf("--http-tls-client-ca requires --http-tls-cert and --http-tls-key")
+				return ErrMissingArgument
+			}
 
-						raw, err := json.Marshal(result)
-						if err != nil {
-							log.Errorf("failed to encode json: %s", err)
-							http.Error(response, "500 internal server error", http.StatusInternalServerError)
-							return
-						}
+			go func() {
+				defer close(httping)
 
-						response.Header().Set("Content-Type", "application/json; charset=utf-8")
-						response.Write(raw)
-					}
+				var err error
+				if server.TLSConfig != nil {
+					log.Noticef("listening for https connection on %s", server.Addr)
+					err = server.ListenAndServeTLS("", "")
+				} else {
+					log.Noticef("listening for http connection on %s", server.Addr)
+					err = server.ListenAndServe()
 				}
-
-				mux := http.NewServeMux()
-				mux.HandleFunc("/api/user", wrapHandler(func(request *http.Request) (interface{}, error) {
-					return gateway.ListUsers()
-				}))
-				mux.HandleFunc("/api/user/", wrapHandler(func(request *http.Request) (interface{}, error) {
-					parts := strings.Split(request.URL.Path, "/")
-					if len(parts) != 4 {
-						return nil, ErrNotFound
-					}
-					user, err := gateway.GetUser(parts[3])
-					if err != nil {
-						return nil, err
-					}
-					if user == nil {
-						return nil, ErrNotFound
-					}
-					return user, nil
-				}))
-
-				if c.Bool("debug-pprof") {
-					mux.HandleFunc("/debug/pprof/", pprof.Index)
-					mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-					mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-					mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-					mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+				if quit {
+					return
+				}
+				if err != nil {
+					log.Errorf("http server exited with error: %s", err)
 				}
+			}()
+		}
+
+		// serve pprof on its own listener, which has no authentication
+		pprofing := make(chan struct{})
+		if c.String("listen-pprof") != "" {
+			listener, err := listenLoopback(c.String("listen-pprof"))
+			if err != nil {
+				log.Errorf("failed to listen on \"%s\": %s", c.String("listen-pprof"), err)
+				return err
+			}
+
+			go func() {
+				defer close(pprofing)
 
-				log.Noticef("listening for http connection on %s", c.String("listen-http"))
-				err := http.ListenAndServe(c.String("listen-http"), mux)
+				log.Noticef("listening for pprof connection on %s", c.String("listen-pprof"))
+				err := http.Serve(listener, newPprofHandler())
 				if quit {
 					return
 				}
 				if err != nil {
-					log.Errorf("http server exited with error: %s", err)
+					log.Errorf("pprof server exited with error: %s", err)
 				}
 			}()
 		}
 
 		// wait till exit
 		signaling := make(chan os.Signal, 1)
-		signal.Notify(signaling, os.Interrupt)
+		signal.Notify(signaling, os.Interrupt, syscall.SIGTERM)
+		reloading := make(chan os.Signal, 1)
+		signal.Notify(reloading, syscall.SIGHUP)
 		for !quit {
 			select {
 			case <-signaling:
 				quit = true
+				shutdown = true
+			case <-reloading:
+				log.Noticef("reloading keys and certificates ...")
+				if err := settings.ReloadFunc(); err != nil {
+					log.Errorf("failed to reload, keeping the current configuration: %s", err)
+				}
 			case <-sshing:
 				quit = true
 			case <-httping:
 				quit = true
+			case <-pprofing:
+				quit = true
 			case <-time.After(10 * time.Second):
 				gateway.ScavengeConnections(idleTimeout)
 			}
 		}
 
+		// stop accepting connections, and let open tunnels finish unless signaled again
+		if shutdown {
+			closeListener()
+			log.Noticef("shutting down, signal again to exit immediately ...")
+			draining := make(chan struct{})
+			go func() {
+				defer close(draining)
+				gateway.Shutdown(drainTimeout)
+			}()
+			select {
+			case <-draining:
+			case <-signaling:
+				log.Warningf("signaled again, closing all connections")
+			}
+		}
+
 		log.Noticef("exiting ...")
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "config",
+			Usage: "work with the config file given by --config",
+			Subcommands: []cli.Command{
+				{
+					Name:      "check",
+					Usage:     "check a config file together with flags and environment variables, without starting the daemon",
+					ArgsUsage: "[config.yaml]",
+					Action: func(c *cli.Context) error {
+						configureLogging(c.GlobalString("log-level"), c.GlobalString("log-format"))
+
+						if err := checkConfig(c, app.Flags); err != nil {
+							log.Errorf("invalid config: %s", err)
+							return cli.NewExitError("", 1)
+						}
+						fmt.Println("config ok")
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "token",
+			Usage: "issue a signed http api bearer token using --http-token-secret",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "user",
+					Usage: "user the token is issued to",
+				},
+				&cli.BoolFlag{
+					Name:  "admin",
+					Usage: "grant admin access",
+				},
+				&cli.StringFlag{
+					Name:  "validity",
+					Value: "24h",
+					Usage: "how long the token is valid for",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				configureLogging(c.GlobalString("log-level"), c.GlobalString("log-format"))
+
+				if c.GlobalString("http-token-secret") == "" || c.String("user") == "" {
+					log.Errorf("both --http-token-secret and --user are required")
+					return ErrMissingArgument
+				}
+
+				validity, err := time.ParseDuration(c.String("validity"))
+				if err != nil {
+					log.Errorf("failed to parse validity \"%s\": %s", c.String("validity"), err)
+					return err
+				}
+
+				token, err := issueSignedToken([]byte(c.GlobalString("http-token-secret")), c.String("user"), c.Bool("admin"), validity)
+				if err != nil {
+					log.Errorf("failed to issue token: %s", err)
+					return err
+				}
+
+				fmt.Println(token)
+				return nil
+			},
+		},
+	}
+
 	app.Run(args)
 }
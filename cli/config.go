@@ -0,0 +1,342 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ziyan/gatewaysshd/gateway"
+)
+
+var (
+	ErrUnknownSetting = errors.New("gatewaysshd: unknown setting in config file")
+	ErrInvalidSetting = errors.New("gatewaysshd: invalid setting in config file")
+	ErrInvalidWebhook = errors.New("gatewaysshd: invalid webhook in config file")
+	ErrPolicyConflict = errors.New("gatewaysshd: policy given both as a file and a section of the config file")
+)
+
+// prefix of the environment variables that set flags, such as GATEWAYSSHD_LISTEN_SSH for --listen-ssh
+const envVarPrefix = "GATEWAYSSHD_"
+
+// flags that hold durations, checked by config check
+var durationFlags = []string{
+	"certificate-validity",
+	"renewal-window",
+	"auth-socket-timeout",
+	"ban-window",
+	"ban-duration",
+	"idle-timeout",
+	"drain-timeout",
+	"webhook-timeout",
+}
+
+// a yaml config file, where flags are set by their names without dashes in front,
+// and policies are given in structured sections, such as:
+//
+//	listen-ssh: ":2020"
+//	host-certificate: [id_ed25519.host-cert.pub, id_rsa.host-cert.pub]
+//	enrollment: true
+//	access_policy:
+//	  rules:
+//	    - action: deny
+//	      countries: [XX]
+//	webhooks:
+//	  - url: https://hooks.example.com/gateway
+//	    events: ["connection.*"]
+type config struct {
+	// values of flags by name
+	Flags map[string]interface{} `yaml:",inline"`
+
+	// the certificate policy, as in the file of --ca-policy
+	CertificatePolicy yaml.Node `yaml:"ca_policy"`
+
+	// the access policy, as in the file of --access-policy
+	AccessPolicy yaml.Node `yaml:"access_policy"`
+
+	// webhooks, in addition to those of --webhook-url
+	Webhooks []*webhookConfig `yaml:"webhooks"`
+}
+
+// a webhook in the config file, unset values default to the webhook flags
+type webhookConfig struct {
+	URL       string   `yaml:"url"`
+	Events    []string `yaml:"events"`
+	Users     []string `yaml:"users"`
+	Secret    string   `yaml:"secret"`
+	QueueSize int      `yaml:"queue_size"`
+	Retries   *int     `yaml:"retries"`
+	Timeout   string   `yaml:"timeout"`
+}
+
+// the environment variable of a flag
+func envVar(name string) string {
+	return envVarPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// let every flag be set by its environment variable
+func setEnvVars(flags []cli.Flag) {
+	for _, flag := range flags {
+		switch flag := flag.(type) {
+		case *cli.StringFlag:
+			flag.EnvVar = envVar(flag.Name)
+		case *cli.StringSliceFlag:
+			flag.EnvVar = envVar(flag.Name)
+		case *cli.BoolFlag:
+			flag.EnvVar = envVar(flag.Name)
+		case *cli.IntFlag:
+			flag.EnvVar = envVar(flag.Name)
+		}
+	}
+}
+
+// read and parse the config file, the values of flags and the sections are checked
+// against the flags of the app
+func loadConfig(filename string, flags []cli.Flag) (*config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]cli.Flag)
+	for _, flag := range flags {
+		known[flag.GetName()] = flag
+	}
+	for name, value := range config.Flags {
+		flag, ok := known[name]
+		if !ok || name == "config" {
+			return nil, fmt.Errorf("%s: %s", ErrUnknownSetting, name)
+		}
+		if _, err := flagValues(flag, value); err != nil {
+			return nil, fmt.Errorf("%s: %s", err, name)
+		}
+	}
+
+	if _, err := config.certificatePolicy(); err != nil {
+		return nil, fmt.Errorf("ca_policy: %s", err)
+	}
+	if _, err := config.accessPolicy(); err != nil {
+		return nil, fmt.Errorf("access_policy: %s", err)
+	}
+	for i, webhook := range config.Webhooks {
+		if parsed, err := url.Parse(webhook.URL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("%s: %d", ErrInvalidWebhook, i+1)
+		}
+		if webhook.Timeout != "" {
+			if _, err := time.ParseDuration(webhook.Timeout); err != nil {
+				return nil, fmt.Errorf("%s: %d: %s", ErrInvalidWebhook, i+1, err)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// the values a setting sets its flag to, repeated flags take a list
+func flagValues(flag cli.Flag, value interface{}) ([]string, error) {
+	if values, ok := value.([]interface{}); ok {
+		if _, ok := flag.(*cli.StringSliceFlag); !ok {
+			return nil, ErrInvalidSetting
+		}
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			converted, err := flagValue(value)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, converted)
+		}
+		return result, nil
+	}
+
+	converted, err := flagValue(value)
+	if err != nil {
+		return nil, err
+	}
+	switch flag.(type) {
+	case *cli.BoolFlag:
+		if _, err := strconv.ParseBool(converted); err != nil {
+			return nil, ErrInvalidSetting
+		}
+	case *cli.IntFlag:
+		if _, err := strconv.Atoi(converted); err != nil {
+			return nil, ErrInvalidSetting
+		}
+	}
+	return []string{converted}, nil
+}
+
+func flagValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	}
+	return "", ErrInvalidSetting
+}
+
+// set the flags that were given neither on the command line nor by environment variables
+func (config *config) apply(c *cli.Context, flags []cli.Flag) error {
+	known := make(map[string]cli.Flag)
+	for _, flag := range flags {
+		known[flag.GetName()] = flag
+	}
+	for name, value := range config.Flags {
+		if c.GlobalIsSet(name) {
+			continue
+		}
+		values, err := flagValues(known[name], value)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if err := c.GlobalSet(name, value); err != nil {
+				return fmt.Errorf("%s: %s: %s", ErrInvalidSetting, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *config) certificatePolicy() (*gateway.CertificatePolicy, error) {
+	if config == nil || config.CertificatePolicy.Kind == 0 {
+		return nil, nil
+	}
+	data, err := yaml.Marshal(&config.CertificatePolicy)
+	if err != nil {
+		return nil, err
+	}
+	return gateway.ParseCertificatePolicy(data)
+}
+
+func (config *config) accessPolicy() (*gateway.AccessPolicy, error) {
+	if config == nil || config.AccessPolicy.Kind == 0 {
+		return nil, nil
+	}
+	data, err := yaml.Marshal(&config.AccessPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return gateway.ParseAccessPolicy(data)
+}
+
+// the webhooks of the config file, with the webhook flags as defaults
+func (config *config) webhooks(c *cli.Context, timeout time.Duration) []*gateway.WebhookSettings {
+	if config == nil {
+		return nil
+	}
+	var webhooks []*gateway.WebhookSettings
+	for _, webhook := range config.Webhooks {
+		settings := &gateway.WebhookSettings{
+			URL:        webhook.URL,
+			Types:      webhook.Events,
+			Users:      webhook.Users,
+			Secret:     webhook.Secret,
+			QueueSize:  webhook.QueueSize,
+			MaxRetries: c.Int("webhook-retries"),
+			Timeout:    timeout,
+		}
+		if settings.QueueSize == 0 {
+			settings.QueueSize = c.Int("webhook-queue-size")
+		}
+		if webhook.Retries != nil {
+			settings.MaxRetries = *webhook.Retries
+		}
+		if webhook.Timeout != "" {
+			settings.Timeout, _ = time.ParseDuration(webhook.Timeout)
+		}
+		webhooks = append(webhooks, settings)
+	}
+	return webhooks
+}
+
+// re-read the config file given by --config, nil when there is none
+func currentConfig(c *cli.Context, flags []cli.Flag) (*config, error) {
+	if c.GlobalString("config") == "" {
+		return nil, nil
+	}
+	return loadConfig(c.GlobalString("config"), flags)
+}
+
+// the certificate and access policies from the files of --ca-policy and --access-policy,
+// or the sections of the config file
+func loadPolicies(c *cli.Context, flags []cli.Flag) (*gateway.CertificatePolicy, *gateway.AccessPolicy, error) {
+	config, err := currentConfig(c, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificatePolicy, err := config.certificatePolicy()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.GlobalString("ca-policy") != "" {
+		if certificatePolicy != nil {
+			return nil, nil, ErrPolicyConflict
+		}
+		if certificatePolicy, err = loadCertificatePolicy(c.GlobalString("ca-policy")); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	accessPolicy, err := config.accessPolicy()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.GlobalString("access-policy") != "" {
+		if accessPolicy != nil {
+			return nil, nil, ErrPolicyConflict
+		}
+		if accessPolicy, err = loadAccessPolicy(c.GlobalString("access-policy")); err != nil {
+			return nil, nil, err
+		}
+	}
+	return certificatePolicy, accessPolicy, nil
+}
+
+// check the config file, and the settings it results in together with flags and environment variables
+func checkConfig(c *cli.Context, flags []cli.Flag) error {
+	filename := c.GlobalString("config")
+	if c.NArg() > 0 {
+		filename = c.Args().First()
+	}
+	if filename == "" {
+		return ErrMissingArgument
+	}
+
+	config, err := loadConfig(filename, flags)
+	if err != nil {
+		return err
+	}
+	if c.GlobalString("config") != filename {
+		if err := config.apply(c, flags); err != nil {
+			return err
+		}
+		if err := c.GlobalSet("config", filename); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range durationFlags {
+		if _, err := time.ParseDuration(c.GlobalString(name)); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if _, _, err := loadPolicies(c, flags); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/ziyan/gatewaysshd/gateway"
+)
+
+var (
+	ErrBadRequest       = errors.New("400: bad request")
+	ErrNotFound         = errors.New("404: not found")
+	ErrMethodNotAllowed = errors.New("405: method not allowed")
+)
+
+func writeError(response http.ResponseWriter, request *http.Request, err error) {
+	switch err {
+	case ErrBadRequest:
+		http.Error(response, err.Error(), http.StatusBadRequest)
+	case ErrNotFound:
+		http.NotFound(response, request)
+	case ErrMethodNotAllowed:
+		http.Error(response, err.Error(), http.StatusMethodNotAllowed)
+	case ErrUnauthorized:
+		response.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(response, err.Error(), http.StatusUnauthorized)
+	case ErrForbidden:
+		http.Error(response, err.Error(), http.StatusForbidden)
+	default:
+		log.Errorf("failed to handle request: %s", err)
+		http.Error(response, "500 internal server error", http.StatusInternalServerError)
+	}
+}
+
+func wrapHandler(auth *httpAuthenticator, handler func(*http.Request, *identity) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		identity, err := auth.authenticate(request)
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+
+		result, err := handler(request, identity)
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+
+		raw, err := json.Marshal(result)
+		if err != nil {
+			log.Errorf("failed to encode json: %s", err)
+			http.Error(response, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		response.Header().Set("Content-Type", "application/json; charset=utf-8")
+		response.Write(raw)
+	}
+}
+
+// wrap a plain handler, only letting authenticated admins through
+func requireAdmin(auth *httpAuthenticator, handler http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		identity, err := auth.authenticate(request)
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+		if !identity.admin {
+			writeError(response, request, ErrForbidden)
+			return
+		}
+		handler(response, request)
+	}
+}
+
+// returns the id in a path like /api/<resource>/<id>
+func parseID(request *http.Request) (string, error) {
+	parts := strings.Split(request.URL.Path, "/")
+	if len(parts) != 4 || parts[3] == "" {
+		return "", ErrNotFound
+	}
+	return parts[3], nil
+}
+
+// the reason given for a disconnect, recorded in logs and sent to the client
+func parseReason(request *http.Request) string {
+	reason := request.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "closed by administrator"
+	}
+	return reason + " (by http api from " + request.RemoteAddr + ")"
+}
+
+// stream gateway events as server-sent events, non-admins only see their own events
+func serveEvents(g *gateway.Gateway, auth *httpAuthenticator, response http.ResponseWriter, request *http.Request) {
+	identity, err := auth.authenticate(request)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	query := request.URL.Query()
+	users := query["user"]
+	if !identity.admin {
+		users = []string{identity.user}
+	}
+	filter, err := gateway.NewEventFilter(query["type"], users)
+	if err != nil {
+		http.Error(response, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	subscription := g.Subscribe(filter)
+	defer subscription.Close()
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(event *gateway.Event) bool {
+		raw, err := json.Marshal(event)
+		if err != nil {
+			log.Errorf("failed to encode json: %s", err)
+			return false
+		}
+		if _, err := fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event.Type, raw); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return
+			}
+			if dropped := subscription.TakeDropped(); dropped > 0 {
+				if !write(&gateway.Event{
+					Type:      gateway.EventDropped,
+					Timestamp: time.Now().Unix(),
+					Data: map[string]interface{}{
+						"count": dropped,
+					},
+				}) {
+					return
+				}
+			}
+			if !write(event) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(response, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func newHTTPHandler(gateway *gateway.Gateway, auth *httpAuthenticator, debugPprof bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", requireAdmin(auth, func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := gateway.WriteMetrics(response); err != nil {
+			log.Warningf("failed to write metrics: %s", err)
+		}
+	}))
+	mux.HandleFunc("/api/user", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		var ids []string
+		if !identity.admin {
+			ids = []string{identity.user}
+		}
+		users, err := gateway.ListUsers(ids...)
+		if err != nil {
+			return nil, err
+		}
+		return &usersResponse{
+			Users: users,
+			Meta: &listMeta{
+				TotalCount: len(users),
+			},
+		}, nil
+	}))
+	mux.HandleFunc("/api/user/", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		id, err := parseID(request)
+		if err != nil {
+			return nil, err
+		}
+		if !identity.canAccess(id) {
+			return nil, ErrForbidden
+		}
+
+		switch request.Method {
+		case http.MethodGet:
+			user, err := gateway.GetUser(id)
+			if err != nil {
+				return nil, err
+			}
+			if user == nil {
+				return nil, ErrNotFound
+			}
+			return &userResponse{
+				User: user,
+			}, nil
+
+		case http.MethodDelete:
+			if !identity.admin {
+				return nil, ErrForbidden
+			}
+			count := gateway.KillUser(id, parseReason(request))
+			if count == 0 {
+				return nil, ErrNotFound
+			}
+			return map[string]interface{}{
+				"connections_closed": count,
+			}, nil
+		}
+		return nil, ErrMethodNotAllowed
+	}))
+	mux.HandleFunc("/api/connections", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		return listConnections(gateway, request, identity)
+	}))
+	connectionHandler := wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		id, err := parseID(request)
+		if err != nil {
+			return nil, err
+		}
+
+		switch request.Method {
+		case http.MethodGet:
+			connection := gateway.GetConnection(id)
+			if connection == nil || !identity.canAccess(connection.User) {
+				return nil, ErrNotFound
+			}
+			return &connectionResponse{
+				Connection: connection,
+			}, nil
+
+		case http.MethodDelete:
+			if !identity.admin {
+				return nil, ErrForbidden
+			}
+			if !gateway.KillConnection(id, parseReason(request)) {
+				return nil, ErrNotFound
+			}
+			return map[string]interface{}{
+				"connections_closed": 1,
+			}, nil
+		}
+		return nil, ErrMethodNotAllowed
+	})
+	mux.HandleFunc("/api/connections/", connectionHandler)
+	mux.HandleFunc("/api/connection/", connectionHandler)
+	mux.HandleFunc("/api/services", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		return listServices(gateway, request, identity)
+	}))
+	mux.HandleFunc("/api/tunnels", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		return listTunnels(gateway, request, identity)
+	}))
+	tunnelHandler := wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		id, err := parseID(request)
+		if err != nil {
+			return nil, err
+		}
+		if !identity.admin {
+			return nil, ErrForbidden
+		}
+		if request.Method != http.MethodDelete {
+			return nil, ErrMethodNotAllowed
+		}
+		if !gateway.CloseTunnel(id, parseReason(request)) {
+			return nil, ErrNotFound
+		}
+		return map[string]interface{}{
+			"tunnels_closed": 1,
+		}, nil
+	})
+	mux.HandleFunc("/api/tunnels/", tunnelHandler)
+	mux.HandleFunc("/api/tunnel/", tunnelHandler)
+
+	mux.HandleFunc("/api/keys", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		return handleKeys(gateway, request, identity)
+	}))
+	mux.HandleFunc("/api/keys/tokens", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		return handleEnrollmentTokens(gateway, request, identity)
+	}))
+	mux.HandleFunc("/api/certificates", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		return listCertificates(gateway, request, identity)
+	}))
+	mux.HandleFunc("/api/certificates/tokens", wrapHandler(auth, func(request *http.Request, identity *identity) (interface{}, error) {
+		return handleCertificateTokens(gateway, request, identity)
+	}))
+
+	mux.HandleFunc("/api/events", func(response http.ResponseWriter, request *http.Request) {
+		serveEvents(gateway, auth, response, request)
+	})
+
+	if debugPprof {
+		registerPprof(mux, func(handler http.HandlerFunc) http.HandlerFunc {
+			return requireAdmin(auth, handler)
+		})
+	}
+	return mux
+}
+
+// a handler serving only pprof, without authentication, for a listener bound to localhost
+func newPprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	registerPprof(mux, func(handler http.HandlerFunc) http.HandlerFunc {
+		return handler
+	})
+	return mux
+}
+
+func registerPprof(mux *http.ServeMux, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("/debug/pprof/", wrap(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", wrap(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", wrap(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", wrap(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", wrap(pprof.Trace))
+}
+
+// listen on an address, refusing anything other than a loopback address
+func listenLoopback(address string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, ErrNotLoopback
+		}
+	}
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ziyan/gatewaysshd/gateway"
+)
+
+// the body of a request to add a key or create an enrollment token
+type keyRequest struct {
+	User  string `json:"user"`
+	Label string `json:"label"`
+	Admin bool   `json:"admin"`
+
+	// in authorized keys format, only when adding a key
+	PublicKey string `json:"public_key"`
+
+	// unix timestamp when the key expires, zero means never
+	Expires int64 `json:"expires"`
+
+	// how long an enrollment token is valid, such as "24h"
+	Validity string `json:"validity"`
+}
+
+type keysResponse struct {
+	Keys []*gateway.KeyInfo `json:"keys"`
+	Meta *listMeta          `json:"meta"`
+}
+
+type keyResponse struct {
+	Key *gateway.KeyInfo `json:"key"`
+}
+
+type tokenResponse struct {
+	Token string `json:"token"`
+}
+
+func parseKeyRequest(request *http.Request) (*keyRequest, *gateway.KeyOptions, error) {
+	var body keyRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil || body.User == "" {
+		return nil, nil, ErrBadRequest
+	}
+
+	options := &gateway.KeyOptions{
+		Label: body.Label,
+		Admin: body.Admin,
+	}
+	if body.Expires != 0 {
+		options.Expires = time.Unix(body.Expires, 0)
+	}
+	return &body, options, nil
+}
+
+// list, add and delete keys, where a key is deleted by its user and fingerprint
+// given as query parameters, since fingerprints may contain slashes
+func handleKeys(g *gateway.Gateway, request *http.Request, identity *identity) (interface{}, error) {
+	if !identity.admin {
+		return nil, ErrForbidden
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		keys, err := g.ListKeys(request.URL.Query().Get("user"))
+		if err != nil {
+			return nil, err
+		}
+		return &keysResponse{
+			Keys: keys,
+			Meta: &listMeta{
+				TotalCount: len(keys),
+			},
+		}, nil
+
+	case http.MethodPost:
+		body, options, err := parseKeyRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body.PublicKey))
+		if err != nil {
+			return nil, ErrBadRequest
+		}
+		info, err := g.AddKey(body.User, key, options)
+		if err == gateway.ErrInvalidKey || err == gateway.ErrKeyAlreadyExists {
+			return nil, ErrBadRequest
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &keyResponse{
+			Key: info,
+		}, nil
+
+	case http.MethodDelete:
+		query := request.URL.Query()
+		if query.Get("user") == "" || query.Get("fingerprint") == "" {
+			return nil, ErrBadRequest
+		}
+		deleted, err := g.DeleteKey(query.Get("user"), query.Get("fingerprint"))
+		if err != nil {
+			return nil, err
+		}
+		if !deleted {
+			return nil, ErrNotFound
+		}
+		return map[string]interface{}{
+			"keys_deleted": 1,
+		}, nil
+	}
+	return nil, ErrMethodNotAllowed
+}
+
+func handleEnrollmentTokens(g *gateway.Gateway, request *http.Request, identity *identity) (interface{}, error) {
+	if !identity.admin {
+		return nil, ErrForbidden
+	}
+	if request.Method != http.MethodPost {
+		return nil, ErrMethodNotAllowed
+	}
+
+	body, options, err := parseKeyRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	validity := 24 * time.Hour
+	if body.Validity != "" {
+		if validity, err = time.ParseDuration(body.Validity); err != nil {
+			return nil, ErrBadRequest
+		}
+	}
+
+	token, err := g.CreateEnrollmentToken(body.User, validity, options)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenResponse{
+		Token: token,
+	}, nil
+}
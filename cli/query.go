@@ -0,0 +1,298 @@
+package cli
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ziyan/gatewaysshd/gateway"
+)
+
+// the query parameters shared by list endpoints
+type listQuery struct {
+	// glob patterns, each parameter may be repeated and any pattern may match
+	users     []string
+	services  []string
+	countries []string
+
+	// certificate key ids as glob patterns and serials, only used by connections
+	keyIDs  []string
+	serials []string
+
+	// field to sort by, prefixed with "-" for descending order
+	sort       string
+	descending bool
+
+	// pagination, a limit of 0 returns all results
+	limit  int
+	offset int
+}
+
+// information about a page of results
+type listMeta struct {
+	TotalCount int `json:"total_count"`
+	Offset     int `json:"offset"`
+	Limit      int `json:"limit,omitempty"`
+}
+
+type usersResponse struct {
+	Users []*gateway.UserInfo `json:"users"`
+	Meta  *listMeta           `json:"meta"`
+}
+
+type userResponse struct {
+	User *gateway.UserInfo `json:"user"`
+}
+
+type connectionsResponse struct {
+	Connections []*gateway.ConnectionInfo `json:"connections"`
+	Meta        *listMeta                 `json:"meta"`
+}
+
+type connectionResponse struct {
+	Connection *gateway.ConnectionInfo `json:"connection"`
+}
+
+type servicesResponse struct {
+	Services []*gateway.ServiceInfo `json:"services"`
+	Meta     *listMeta              `json:"meta"`
+}
+
+type tunnelsResponse struct {
+	Tunnels []*gateway.TunnelInfo `json:"tunnels"`
+	Meta    *listMeta             `json:"meta"`
+}
+
+func parseListQuery(request *http.Request, defaultSort string) (*listQuery, error) {
+	values := request.URL.Query()
+	query := &listQuery{
+		users:     values["user"],
+		services:  values["service"],
+		countries: values["country"],
+		keyIDs:    values["key_id"],
+		serials:   values["serial"],
+		sort:      defaultSort,
+	}
+
+	for _, pattern := range append(append(append(append([]string{}, query.users...), query.services...), query.countries...), query.keyIDs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, ErrBadRequest
+		}
+	}
+
+	if value := values.Get("sort"); value != "" {
+		query.sort = value
+	}
+	if strings.HasPrefix(query.sort, "-") {
+		query.sort = strings.TrimPrefix(query.sort, "-")
+		query.descending = true
+	}
+
+	var err error
+	if value := values.Get("limit"); value != "" {
+		if query.limit, err = strconv.Atoi(value); err != nil || query.limit < 0 {
+			return nil, ErrBadRequest
+		}
+	}
+	if value := values.Get("offset"); value != "" {
+		if query.offset, err = strconv.Atoi(value); err != nil || query.offset < 0 {
+			return nil, ErrBadRequest
+		}
+	}
+	return query, nil
+}
+
+// whether any of the patterns matches any of the values, no patterns match everything
+func matchAny(patterns []string, values ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether the serial is any of the given serials, no serials match everything
+func matchSerial(serials []string, serial uint64) bool {
+	if len(serials) == 0 {
+		return true
+	}
+	for _, value := range serials {
+		if value == strconv.FormatUint(serial, 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// sort in the requested order
+func (q *listQuery) sortSlice(slice interface{}, less func(i, j int) bool) {
+	if q.descending {
+		sort.SliceStable(slice, func(i, j int) bool { return less(j, i) })
+		return
+	}
+	sort.SliceStable(slice, less)
+}
+
+// returns the bounds of the requested page and its metadata
+func (q *listQuery) page(total int) (int, int, *listMeta) {
+	start := q.offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if q.limit > 0 && start+q.limit < end {
+		end = start + q.limit
+	}
+	return start, end, &listMeta{
+		TotalCount: total,
+		Offset:     q.offset,
+		Limit:      q.limit,
+	}
+}
+
+func listConnections(g *gateway.Gateway, request *http.Request, identity *identity) (interface{}, error) {
+	query, err := parseListQuery(request, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	connections := make([]*gateway.ConnectionInfo, 0)
+	for _, connection := range g.ListConnections() {
+		if !identity.canAccess(connection.User) {
+			continue
+		}
+		services := make([]string, 0, len(connection.Services))
+		for host := range connection.Services {
+			services = append(services, host+"."+connection.User)
+		}
+		if !matchAny(query.users, connection.User) || !matchAny(query.services, services...) || !matchAny(query.countries, connection.Country()) {
+			continue
+		}
+		if len(query.keyIDs) > 0 || len(query.serials) > 0 {
+			if connection.Certificate == nil {
+				continue
+			}
+			if !matchAny(query.keyIDs, connection.Certificate.KeyID) || !matchSerial(query.serials, connection.Certificate.Serial) {
+				continue
+			}
+		}
+		connections = append(connections, connection)
+	}
+
+	less, ok := map[string]func(i, j int) bool{
+		"id":            func(i, j int) bool { return connections[i].ID < connections[j].ID },
+		"user":          func(i, j int) bool { return connections[i].User < connections[j].User },
+		"address":       func(i, j int) bool { return connections[i].Address < connections[j].Address },
+		"country":       func(i, j int) bool { return connections[i].Country() < connections[j].Country() },
+		"created":       func(i, j int) bool { return connections[i].Created < connections[j].Created },
+		"used":          func(i, j int) bool { return connections[i].Used < connections[j].Used },
+		"bytes_read":    func(i, j int) bool { return connections[i].BytesRead < connections[j].BytesRead },
+		"bytes_written": func(i, j int) bool { return connections[i].BytesWritten < connections[j].BytesWritten },
+	}[query.sort]
+	if !ok {
+		return nil, ErrBadRequest
+	}
+	query.sortSlice(connections, less)
+
+	start, end, meta := query.page(len(connections))
+	return &connectionsResponse{
+		Connections: connections[start:end],
+		Meta:        meta,
+	}, nil
+}
+
+func listServices(g *gateway.Gateway, request *http.Request, identity *identity) (interface{}, error) {
+	query, err := parseListQuery(request, "name")
+	if err != nil {
+		return nil, err
+	}
+
+	countries := connectionCountries(g, query)
+	services := make([]*gateway.ServiceInfo, 0)
+	for _, service := range g.ListServices() {
+		if !identity.canAccess(service.User) {
+			continue
+		}
+		if !matchAny(query.users, service.User) || !matchAny(query.services, service.Name) || !matchAny(query.countries, countries[service.Connection]) {
+			continue
+		}
+		services = append(services, service)
+	}
+
+	less, ok := map[string]func(i, j int) bool{
+		"name":          func(i, j int) bool { return services[i].Name < services[j].Name },
+		"user":          func(i, j int) bool { return services[i].User < services[j].User },
+		"registered":    func(i, j int) bool { return services[i].Registered < services[j].Registered },
+		"tunnels_count": func(i, j int) bool { return services[i].TunnelsCount < services[j].TunnelsCount },
+	}[query.sort]
+	if !ok {
+		return nil, ErrBadRequest
+	}
+	query.sortSlice(services, less)
+
+	start, end, meta := query.page(len(services))
+	return &servicesResponse{
+		Services: services[start:end],
+		Meta:     meta,
+	}, nil
+}
+
+func listTunnels(g *gateway.Gateway, request *http.Request, identity *identity) (interface{}, error) {
+	query, err := parseListQuery(request, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	countries := connectionCountries(g, query)
+	tunnels := make([]*gateway.TunnelInfo, 0)
+	for _, tunnel := range g.ListTunnels() {
+		if !identity.canAccess(tunnel.User) {
+			continue
+		}
+		service := ""
+		if tunnel.Service != nil {
+			service = tunnel.Service.Host
+		}
+		if !matchAny(query.users, tunnel.User) || !matchAny(query.services, service) || !matchAny(query.countries, countries[tunnel.Connection]) {
+			continue
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+
+	less, ok := map[string]func(i, j int) bool{
+		"id":         func(i, j int) bool { return tunnels[i].ID < tunnels[j].ID },
+		"user":       func(i, j int) bool { return tunnels[i].User < tunnels[j].User },
+		"type":       func(i, j int) bool { return tunnels[i].Type < tunnels[j].Type },
+		"connection": func(i, j int) bool { return tunnels[i].Connection < tunnels[j].Connection },
+	}[query.sort]
+	if !ok {
+		return nil, ErrBadRequest
+	}
+	query.sortSlice(tunnels, less)
+
+	start, end, meta := query.page(len(tunnels))
+	return &tunnelsResponse{
+		Tunnels: tunnels[start:end],
+		Meta:    meta,
+	}, nil
+}
+
+// country codes by connection id, only looked up when filtering by country
+func connectionCountries(g *gateway.Gateway, query *listQuery) map[string]string {
+	countries := make(map[string]string)
+	if len(query.countries) == 0 {
+		return countries
+	}
+	for _, connection := range g.ListConnections() {
+		countries[connection.ID] = connection.Country()
+	}
+	return countries
+}
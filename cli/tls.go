@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidClientCA = errors.New("gatewaysshd: no certificate found in client ca file")
+)
+
+// how often the files are checked for changes
+const tlsReloadInterval = 5 * time.Second
+
+// serves a tls configuration loaded from files, reloading it when the files change,
+// a failed reload keeps the previous configuration
+type tlsReloader struct {
+	certificateFile string
+	keyFile         string
+	clientCAFile    string
+	config          *tls.Config
+	modified        time.Time
+	checked         time.Time
+	lock            *sync.Mutex
+}
+
+func newTLSReloader(certificateFile, keyFile, clientCAFile string) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certificateFile: certificateFile,
+		keyFile:         keyFile,
+		clientCAFile:    clientCAFile,
+		lock:            &sync.Mutex{},
+	}
+
+	modified, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	config, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.config = config
+	r.modified = modified
+	r.checked = time.Now()
+	return r, nil
+}
+
+// a tls configuration for the server, which defers to the reloaded configuration
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+	}
+}
+
+func (r *tlsReloader) current() *tls.Config {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.checked) < tlsReloadInterval {
+		return r.config
+	}
+	r.checked = time.Now()
+
+	modified, err := r.lastModified()
+	if err != nil {
+		log.Warningf("tls: failed to check certificate files: %s", err)
+		return r.config
+	}
+	if !modified.After(r.modified) {
+		return r.config
+	}
+
+	config, err := r.load()
+	if err != nil {
+		log.Errorf("tls: failed to reload certificate, keeping the previous one: %s", err)
+		return r.config
+	}
+	log.Noticef("tls: reloaded certificate from %s", r.certificateFile)
+	r.config = config
+	r.modified = modified
+	return r.config
+}
+
+func (r *tlsReloader) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, filename := range []string{r.certificateFile, r.keyFile, r.clientCAFile} {
+		if filename == "" {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(r.certificateFile, r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// the configuration is returned for each client in place of the server one,
+	// so it has to offer the protocols the http server would otherwise add itself
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	// client certificates are optional, so that other authentication methods still work
+	if r.clientCAFile != "" {
+		raw, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, ErrInvalidClientCA
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
@@ -0,0 +1,255 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidAccessPolicy    = errors.New("gatewaysshd: invalid access policy")
+	ErrInvalidAccessNetwork   = errors.New("gatewaysshd: invalid network in access policy")
+	ErrInvalidAccessPrincipal = errors.New("gatewaysshd: invalid principal pattern in access policy")
+)
+
+// actions of access rules
+const (
+	accessAllow = "allow"
+	accessDeny  = "deny"
+)
+
+// which addresses may connect, optionally depending on the user, the first matching rule decides
+type AccessPolicy struct {
+	// allow or deny connections that match no rule, defaults to allow
+	Default string `yaml:"default"`
+
+	Rules []*AccessRule `yaml:"rules"`
+}
+
+// a rule matches connections that match all of its conditions, and any of the values of each
+type AccessRule struct {
+	// a name for logging
+	Name string `yaml:"name"`
+
+	// allow or deny
+	Action string `yaml:"action"`
+
+	// glob patterns of users the rule applies to, empty applies to all users
+	Principals []string `yaml:"principals"`
+
+	// networks in cidr notation, or single ip addresses
+	Networks []string `yaml:"networks"`
+
+	// iso country codes looked up in the geoip database
+	Countries []string `yaml:"countries"`
+
+	// autonomous system numbers looked up in the asn database
+	ASNs []uint `yaml:"asns"`
+
+	networks []*net.IPNet
+}
+
+// parse an access policy in yaml format, such as:
+//
+//	default: allow
+//	rules:
+//	  - name: contractors
+//	    action: allow
+//	    principals: ["contractor-*"]
+//	    countries: [US, CA]
+//	  - action: deny
+//	    principals: ["contractor-*"]
+//	  - action: deny
+//	    asns: [64496]
+func ParseAccessPolicy(data []byte) (*AccessPolicy, error) {
+	var policy AccessPolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+
+	if policy.Default == "" {
+		policy.Default = accessAllow
+	}
+	if policy.Default != accessAllow && policy.Default != accessDeny {
+		return nil, ErrInvalidAccessPolicy
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.Action != accessAllow && rule.Action != accessDeny {
+			return nil, ErrInvalidAccessPolicy
+		}
+		for _, pattern := range rule.Principals {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, ErrInvalidAccessPrincipal
+			}
+		}
+		for _, network := range rule.Networks {
+			if !strings.Contains(network, "/") {
+				if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+					network += "/32"
+				} else {
+					network += "/128"
+				}
+			}
+			_, parsed, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, ErrInvalidAccessNetwork
+			}
+			rule.networks = append(rule.networks, parsed)
+		}
+		for j, country := range rule.Countries {
+			rule.Countries[j] = strings.ToUpper(country)
+		}
+		if rule.Name == "" {
+			rule.Name = "#" + strconv.Itoa(i+1)
+		}
+	}
+	return &policy, nil
+}
+
+// decide about a connection from the address, before the handshake the user is not known
+// yet and the decision is deferred when a rule for some principals matches the address first,
+// returns the action and the name of the matching rule, empty for the default
+func (p *AccessPolicy) decide(address *remoteAddress, user string, known bool) (string, string, bool) {
+	for _, rule := range p.Rules {
+		if !rule.matches(address) {
+			continue
+		}
+		if len(rule.Principals) > 0 {
+			if !known {
+				return "", "", false
+			}
+			if !matchesAny(rule.Principals, user) {
+				continue
+			}
+		}
+		return rule.Action, rule.Name, true
+	}
+	return p.Default, "", true
+}
+
+// whether the address matches the network, country and asn conditions of the rule
+func (r *AccessRule) matches(address *remoteAddress) bool {
+	if len(r.networks) > 0 {
+		found := false
+		for _, network := range r.networks {
+			if network.Contains(address.ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Countries) > 0 {
+		country := address.country()
+		found := false
+		for _, candidate := range r.Countries {
+			if candidate == country {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ASNs) > 0 {
+		asn := address.asn()
+		found := false
+		for _, candidate := range r.ASNs {
+			if candidate == asn {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// whether the value matches any of the glob patterns
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// the remote address of a connection, its country and autonomous system are looked up
+// when a rule first needs them
+type remoteAddress struct {
+	gateway       *Gateway
+	ip            net.IP
+	countryCode   string
+	countryLooked bool
+	asnNumber     uint
+	asnLooked     bool
+}
+
+func (a *remoteAddress) country() string {
+	if !a.countryLooked {
+		a.countryCode = lookupCountry(a.gateway.geoip, a.ip)
+		a.countryLooked = true
+	}
+	return a.countryCode
+}
+
+func (a *remoteAddress) asn() uint {
+	if !a.asnLooked {
+		a.asnNumber = lookupASN(a.gateway.asn, a.ip)
+		a.asnLooked = true
+	}
+	return a.asnNumber
+}
+
+// replace the access policy for new connections, nil allows all
+func (g *Gateway) SetAccessPolicy(policy *AccessPolicy) {
+	g.configLock.Lock()
+	defer g.configLock.Unlock()
+
+	g.access = policy
+}
+
+func (g *Gateway) accessPolicy() *AccessPolicy {
+	g.configLock.Lock()
+	defer g.configLock.Unlock()
+
+	return g.access
+}
+
+// check the access policy for a connection from the address, the user is empty before the
+// handshake, returns false when the connection should be dropped
+func (g *Gateway) checkAccess(address *remoteAddress, user string, known bool) bool {
+	policy := g.accessPolicy()
+	if policy == nil || address == nil {
+		return true
+	}
+
+	action, rule, decided := policy.decide(address, user, known)
+	if !decided || action == accessAllow {
+		return true
+	}
+
+	if rule == "" {
+		rule = "default"
+	}
+	if known {
+		log.Warningf("access: denied connection: remote = %s, user = %s, rule = %s", address.ip, user, rule)
+	} else {
+		log.Warningf("access: denied connection before handshake: remote = %s, rule = %s", address.ip, rule)
+	}
+	g.metrics.connectionRejected("access")
+	return false
+}
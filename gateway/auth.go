@@ -0,0 +1,397 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrUnknownUser     = errors.New("gatewaysshd: unknown user")
+	ErrUnknownKey      = errors.New("gatewaysshd: unknown public key")
+	ErrAccessDenied    = errors.New("gatewaysshd: access denied")
+	ErrNoAuthenticator = errors.New("gatewaysshd: no authenticator")
+	ErrNotCertificate  = errors.New("gatewaysshd: normal key pairs not accepted")
+)
+
+// decides whether a public key may log in as the user of the connection,
+// the returned permissions are attached to the connection, where the
+// permit-port-forwarding extension makes the user an admin
+type Authenticator interface {
+	Authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+}
+
+// adapts a function to the authenticator interface
+type AuthenticatorFunc func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+
+func (f AuthenticatorFunc) Authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	return f(meta, key)
+}
+
+// an error for a key that must not be accepted by any other authenticator, such as a
+// revoked, expired or otherwise invalid certificate, which authenticators that only look
+// at the key, like the auth socket helper, would otherwise accept
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// whether the key was rejected for good, however deeply the error is wrapped
+func isRejected(err error) bool {
+	var rejected *RejectedError
+	return errors.As(err, &rejected)
+}
+
+// tries each authenticator in turn, the first one that accepts the key wins,
+// except that a key rejected for good is not passed on to the others
+type MultiAuthenticator []Authenticator
+
+func (m MultiAuthenticator) Authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var result error
+	for _, authenticator := range m {
+		permissions, err := authenticator.Authenticate(meta, key)
+		if err == nil {
+			return permissions, nil
+		}
+
+		if isRejected(err) {
+			return nil, err
+		}
+
+		// why a key was rejected is more useful than the key being of the wrong type
+		if result == nil || result == ErrNotCertificate {
+			result = err
+		}
+	}
+	if result == nil {
+		result = ErrNoAuthenticator
+	}
+	return nil, result
+}
+
+// accepts certificates signed by any of the certificate authorities, unless revoked,
+// and passes down their permissions as the policy allows
+type CertificateAuthenticator struct {
+	authorities    []ssh.PublicKey
+	policy         *CertificatePolicy
+	revocationList string
+	checker        *ssh.CertChecker
+	lock           *sync.Mutex
+}
+
+// creates an authenticator from certificate authority public keys in authorized keys format,
+// and a revocation list file containing one key id, serial or key id/serial per line
+func NewCertificateAuthenticator(caPublicKeys []byte, revocationList string) (*CertificateAuthenticator, error) {
+	a := &CertificateAuthenticator{
+		revocationList: revocationList,
+		lock:           &sync.Mutex{},
+	}
+	if err := a.SetAuthorities(caPublicKeys); err != nil {
+		return nil, err
+	}
+	a.checker = &ssh.CertChecker{
+		IsUserAuthority: a.isAuthority,
+		IsRevoked:       a.isRevoked,
+	}
+	return a, nil
+}
+
+// rejects every certificate it does not accept for good, only plain keys are left to other authenticators
+func (a *CertificateAuthenticator) Authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, ErrNotCertificate
+	}
+
+	permissions, err := a.checker.Authenticate(meta, key)
+	if err != nil {
+		return nil, &RejectedError{Err: err}
+	}
+
+	// certificate authorities without rules pass down no permissions
+	if policy := a.Policy(); policy != nil {
+		if authority := policy.find(cert.SignatureKey); authority != nil {
+			permissions, err := authority.apply(meta.User(), cert, permissions)
+			if err != nil {
+				return nil, &RejectedError{Err: err}
+			}
+			return permissions, nil
+		}
+		return &ssh.Permissions{}, nil
+	}
+
+	// without a policy, only the first ca is allowed to pass down permissions
+	for _, ca := range a.Authorities() {
+		if bytes.Compare(ca.Marshal(), cert.SignatureKey.Marshal()) == 0 {
+			return permissions, nil
+		}
+		break
+	}
+
+	// return empty permission
+	return &ssh.Permissions{}, nil
+}
+
+// check a certificate, such as the host certificate, for validity and revocation
+func (a *CertificateAuthenticator) checkCertificate(principal string, cert *ssh.Certificate) error {
+	return a.checker.CheckCert(principal, cert)
+}
+
+// replace the certificate authorities with public keys in authorized keys format,
+// nothing changes when any of them is invalid
+func (a *CertificateAuthenticator) SetAuthorities(caPublicKeys []byte) error {
+	// parse certificate authority
+	var authorities []ssh.PublicKey
+	for len(caPublicKeys) > 0 {
+		ca, _, _, rest, err := ssh.ParseAuthorizedKey(caPublicKeys)
+		if err != nil {
+			return err
+		}
+		log.Debugf("auth: ca_public_key = %v", ca)
+		authorities = append(authorities, ca)
+		caPublicKeys = rest
+	}
+
+	a.setAuthorities(authorities)
+	return nil
+}
+
+func (a *CertificateAuthenticator) setAuthorities(authorities []ssh.PublicKey) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.authorities = authorities
+}
+
+// replace the policy, nil restores the default where only the first certificate
+// authority passes down permissions
+func (a *CertificateAuthenticator) SetPolicy(policy *CertificatePolicy) {
+	if policy != nil {
+		for _, authority := range policy.Authorities {
+			if !a.isAuthority(authority.key) {
+				log.Warningf("auth: policy %s is for an unknown certificate authority", authority.Name)
+			}
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.policy = policy
+}
+
+func (a *CertificateAuthenticator) Policy() *CertificatePolicy {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.policy
+}
+
+// the certificate authorities in order
+func (a *CertificateAuthenticator) Authorities() []ssh.PublicKey {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.authorities
+}
+
+func (a *CertificateAuthenticator) isAuthority(key ssh.PublicKey) bool {
+	for _, ca := range a.Authorities() {
+		if bytes.Compare(ca.Marshal(), key.Marshal()) == 0 {
+			return true
+		}
+	}
+	log.Warningf("auth: unknown authority: %v", key)
+	return false
+}
+
+func (a *CertificateAuthenticator) isRevoked(cert *ssh.Certificate) bool {
+	// if revocation list file does not exist, assume everything is good
+	if _, err := os.Stat(a.revocationList); os.IsNotExist(err) {
+		return false
+	}
+
+	file, err := os.Open(a.revocationList)
+	if err != nil {
+		log.Errorf("auth: failed to open revocation list: %s", err)
+		return true
+	}
+	defer file.Close()
+
+	// if line matches any of the following, it is considered revoked
+	matches := []string{
+		fmt.Sprintf("%s\n", cert.KeyId),
+		fmt.Sprintf("%d\n", cert.Serial),
+		fmt.Sprintf("%s/%d\n", cert.KeyId, cert.Serial),
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("auth: failed to read revocation list: %s", err)
+			return true
+		}
+		if line[0] == '#' || line == "\n" {
+			continue
+		}
+		for _, match := range matches {
+			if line == match {
+				log.Warningf("auth: certificate revoked by revocation list: %s/%d", cert.KeyId, cert.Serial)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// accepts plain public keys listed for each user, like authorized_keys files of openssh
+type AuthorizedKeysAuthenticator struct {
+	keys map[string][]*authorizedKey
+	lock *sync.Mutex
+}
+
+type authorizedKey struct {
+	key   ssh.PublicKey
+	admin bool
+}
+
+func NewAuthorizedKeysAuthenticator() *AuthorizedKeysAuthenticator {
+	return &AuthorizedKeysAuthenticator{
+		keys: make(map[string][]*authorizedKey),
+		lock: &sync.Mutex{},
+	}
+}
+
+// add keys in authorized keys format for a user, replacing any keys added before,
+// admin grants the user access to all services
+func (a *AuthorizedKeysAuthenticator) SetAuthorizedKeys(user string, authorizedKeys []byte, admin bool) error {
+	var keys []*authorizedKey
+	for len(bytes.TrimSpace(authorizedKeys)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeys)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, &authorizedKey{
+			key:   key,
+			admin: admin,
+		})
+		authorizedKeys = rest
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.keys[user] = keys
+	return nil
+}
+
+func (a *AuthorizedKeysAuthenticator) Authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	keys, ok := a.keys[meta.User()]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	for _, authorized := range keys {
+		if bytes.Equal(authorized.key.Marshal(), key.Marshal()) {
+			return newPermissions(authorized.admin), nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// asks a helper process listening on a unix socket, by writing a json request
+// {"user", "address", "public_key", "fingerprint"} and reading a json response
+// {"allow", "admin", "message"}, one per connection
+type UnixSocketAuthenticator struct {
+	path    string
+	timeout time.Duration
+}
+
+func NewUnixSocketAuthenticator(path string, timeout time.Duration) *UnixSocketAuthenticator {
+	return &UnixSocketAuthenticator{
+		path:    path,
+		timeout: timeout,
+	}
+}
+
+type unixSocketRequest struct {
+	User        string `json:"user"`
+	Address     string `json:"address"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type unixSocketResponse struct {
+	Allow   bool   `json:"allow"`
+	Admin   bool   `json:"admin"`
+	Message string `json:"message"`
+}
+
+func (a *UnixSocketAuthenticator) Authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	conn, err := net.DialTimeout("unix", a.path, a.timeout)
+	if err != nil {
+		log.Errorf("auth: failed to connect to helper %s: %s", a.path, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	if a.timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(a.timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(&unixSocketRequest{
+		User:        meta.User(),
+		Address:     meta.RemoteAddr().String(),
+		PublicKey:   string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	}); err != nil {
+		return nil, err
+	}
+
+	var response unixSocketResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	if !response.Allow {
+		if response.Message != "" {
+			return nil, fmt.Errorf("gatewaysshd: access denied: %s", response.Message)
+		}
+		return nil, ErrAccessDenied
+	}
+	return newPermissions(response.Admin), nil
+}
+
+// permissions for a user authenticated without a certificate
+func newPermissions(admin bool) *ssh.Permissions {
+	permissions := &ssh.Permissions{
+		Extensions: make(map[string]string),
+	}
+	if admin {
+		permissions.Extensions["permit-port-forwarding"] = ""
+	}
+	return permissions
+}
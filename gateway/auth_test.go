@@ -0,0 +1,191 @@
+package gateway
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// a certificate for the principal signed by the ca, valid from an hour ago for the given duration
+func newTestCertificate(t *testing.T, ca ssh.Signer, keyID, principal string, validity time.Duration, criticalOptions map[string]string) *ssh.Certificate {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(-time.Hour + validity).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: criticalOptions,
+			Extensions: map[string]string{
+				"permit-port-forwarding": "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// a certificate authenticator trusting the ca, with a revocation list of the given key ids
+func newTestCertificateAuthenticator(t *testing.T, ca ssh.Signer, revoked ...string) *CertificateAuthenticator {
+	revocationList := filepath.Join(t.TempDir(), "revoked")
+	data := ""
+	for _, keyID := range revoked {
+		data += keyID + "\n"
+	}
+	if err := ioutil.WriteFile(revocationList, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, err := NewCertificateAuthenticator(ssh.MarshalAuthorizedKey(ca.PublicKey()), revocationList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+// an auth socket helper that allows every key as an admin
+func newAllowingHelper(t *testing.T) *UnixSocketAuthenticator {
+	path := filepath.Join(t.TempDir(), "auth.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var request unixSocketRequest
+			if err := json.NewDecoder(conn).Decode(&request); err == nil {
+				json.NewEncoder(conn).Encode(&unixSocketResponse{
+					Allow: true,
+					Admin: true,
+				})
+			}
+			conn.Close()
+		}
+	}()
+	return NewUnixSocketAuthenticator(path, time.Second)
+}
+
+func newTestMetadata(user string) ssh.ConnMetadata {
+	return &keyMetadata{
+		user: user,
+		remoteAddr: &net.TCPAddr{
+			IP:   net.ParseIP("192.0.2.1"),
+			Port: 50000,
+		},
+	}
+}
+
+func TestMultiAuthenticatorRevokedCertificate(t *testing.T) {
+	ca := newTestSigner(t)
+	helper := newAllowingHelper(t)
+	authenticator := MultiAuthenticator{newTestCertificateAuthenticator(t, ca, "revoked"), helper}
+
+	revoked := newTestCertificate(t, ca, "revoked", "device", time.Hour*2, nil)
+	if _, err := helper.Authenticate(newTestMetadata("device"), revoked); err != nil {
+		t.Fatalf("helper should allow any key: %s", err)
+	}
+	if _, err := authenticator.Authenticate(newTestMetadata("device"), revoked); err == nil {
+		t.Fatal("revoked certificate was accepted")
+	}
+
+	valid := newTestCertificate(t, ca, "valid", "device", time.Hour*2, nil)
+	permissions, err := authenticator.Authenticate(newTestMetadata("device"), valid)
+	if err != nil {
+		t.Fatalf("valid certificate was rejected: %s", err)
+	}
+	if !isAdmin(permissions) {
+		t.Fatal("valid certificate of the first ca should pass down its permissions")
+	}
+}
+
+func TestMultiAuthenticatorInvalidCertificate(t *testing.T) {
+	ca := newTestSigner(t)
+	authenticator := MultiAuthenticator{newTestCertificateAuthenticator(t, ca), newAllowingHelper(t)}
+
+	for name, cert := range map[string]*ssh.Certificate{
+		"expired":           newTestCertificate(t, ca, "expired", "device", time.Minute, nil),
+		"wrong principal":   newTestCertificate(t, ca, "other", "other", time.Hour*2, nil),
+		"unknown authority": newTestCertificate(t, newTestSigner(t), "unknown", "device", time.Hour*2, nil),
+	} {
+		if _, err := authenticator.Authenticate(newTestMetadata("device"), cert); err == nil {
+			t.Errorf("%s certificate was accepted", name)
+		}
+	}
+}
+
+func TestMultiAuthenticatorPlainKey(t *testing.T) {
+	authenticator := MultiAuthenticator{newTestCertificateAuthenticator(t, newTestSigner(t)), newAllowingHelper(t)}
+
+	permissions, err := authenticator.Authenticate(newTestMetadata("device"), newTestSigner(t).PublicKey())
+	if err != nil {
+		t.Fatalf("plain key was not passed on to the helper: %s", err)
+	}
+	if !isAdmin(permissions) {
+		t.Fatal("permissions of the helper were not passed down")
+	}
+}
+
+func TestMultiAuthenticatorWrappedCertificateAuthenticator(t *testing.T) {
+	ca := newTestSigner(t)
+	certificates := newTestCertificateAuthenticator(t, ca, "revoked")
+	logging := AuthenticatorFunc(func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		permissions, err := certificates.Authenticate(meta, key)
+		if err != nil {
+			t.Logf("certificate authenticator: %s", err)
+		}
+		return permissions, err
+	})
+
+	revoked := newTestCertificate(t, ca, "revoked", "device", time.Hour*2, nil)
+	for name, authenticator := range map[string]Authenticator{
+		"function": MultiAuthenticator{logging, newAllowingHelper(t)},
+		"nested":   MultiAuthenticator{MultiAuthenticator{certificates}, newAllowingHelper(t)},
+	} {
+		_, err := authenticator.Authenticate(newTestMetadata("device"), revoked)
+		if err == nil {
+			t.Errorf("revoked certificate was accepted through a %s wrapper", name)
+			continue
+		}
+		if !isRejected(err) {
+			t.Errorf("revoked certificate was not rejected for good through a %s wrapper: %s", name, err)
+		}
+	}
+
+	permissions, err := MultiAuthenticator{logging, newAllowingHelper(t)}.Authenticate(newTestMetadata("device"), newTestSigner(t).PublicKey())
+	if err != nil {
+		t.Fatalf("plain key was not passed on to the helper: %s", err)
+	}
+	if !isAdmin(permissions) {
+		t.Fatal("permissions of the helper were not passed down")
+	}
+}
@@ -0,0 +1,308 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// settings of temporary bans of addresses that fail to authenticate too often
+type BanSettings struct {
+	// failed authentications of an ip address within the window before it is banned,
+	// zero disables banning single addresses
+	MaxFailures int
+
+	// failed authentications of all addresses in a /24 or /64 prefix within the window
+	// before the whole prefix is banned, zero disables banning prefixes
+	MaxPrefixFailures int
+
+	// how long failures are counted
+	Window time.Duration
+
+	// how long a ban lasts
+	Duration time.Duration
+
+	// store bans in the database, so that they last across restarts
+	Persist bool
+}
+
+// a banned ip address or prefix
+type BanInfo struct {
+	Address  string `json:"address"`
+	Failures int    `json:"failures"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires"`
+}
+
+// counts failed authentications by ip address and prefix, and bans those over the limits
+type banTracker struct {
+	settings *BanSettings
+	database *Database
+	failures map[string]*failureCount
+	bans     map[string]*banModel
+	lock     *sync.Mutex
+}
+
+// failures counted since the start of the window
+type failureCount struct {
+	count int
+	since time.Time
+}
+
+// creates a tracker, loading persisted bans from the database if any
+func newBanTracker(settings *BanSettings, database *Database) (*banTracker, error) {
+	t := &banTracker{
+		settings: settings,
+		failures: make(map[string]*failureCount),
+		bans:     make(map[string]*banModel),
+		lock:     &sync.Mutex{},
+	}
+	if settings.Persist && database != nil {
+		t.database = database
+
+		bans, err := database.listBans()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().Unix()
+		for _, ban := range bans {
+			if ban.Expires > now {
+				t.bans[ban.Address] = ban
+			}
+		}
+		log.Infof("bans: loaded %d bans from database", len(t.bans))
+	}
+	return t, nil
+}
+
+// the /24 prefix of an ipv4 address, or the /64 prefix of an ipv6 address
+func addressPrefix(ip net.IP) string {
+	mask := net.CIDRMask(64, 128)
+	if ip.To4() != nil {
+		ip = ip.To4()
+		mask = net.CIDRMask(24, 32)
+	}
+	prefix := &net.IPNet{
+		IP:   ip.Mask(mask),
+		Mask: mask,
+	}
+	return prefix.String()
+}
+
+// the ban of the address or its prefix, nil when neither is banned
+func (t *banTracker) banned(ip net.IP) *banModel {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now().Unix()
+	for _, address := range []string{ip.String(), addressPrefix(ip)} {
+		if ban, ok := t.bans[address]; ok && ban.Expires > now {
+			return ban
+		}
+	}
+	return nil
+}
+
+// count a failed authentication, returns the bans it caused
+func (t *banTracker) failed(ip net.IP) []*banModel {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var bans []*banModel
+	if ban := t.count(ip.String(), t.settings.MaxFailures); ban != nil {
+		bans = append(bans, ban)
+	}
+	if ban := t.count(addressPrefix(ip), t.settings.MaxPrefixFailures); ban != nil {
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+// forget the failures of the address after it logged in, its prefix keeps counting
+func (t *banTracker) succeeded(ip net.IP) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.failures, ip.String())
+}
+
+// count a failure of the address, and ban it when over the limit, must hold the lock
+func (t *banTracker) count(address string, limit int) *banModel {
+	if limit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	failure, ok := t.failures[address]
+	if !ok || now.Sub(failure.since) > t.settings.Window {
+		failure = &failureCount{
+			since: now,
+		}
+		t.failures[address] = failure
+	}
+	failure.count++
+	if failure.count < limit {
+		return nil
+	}
+	delete(t.failures, address)
+
+	ban := &banModel{
+		Address:  address,
+		Failures: failure.count,
+		Created:  now.Unix(),
+		Expires:  now.Add(t.settings.Duration).Unix(),
+	}
+	t.bans[address] = ban
+	if t.database != nil {
+		if err := t.database.putBan(ban); err != nil {
+			log.Errorf("bans: failed to store ban of %s: %s", address, err)
+		}
+	}
+	return ban
+}
+
+// lift the ban of an address or prefix, returns false when it was not banned
+func (t *banTracker) unban(address string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.bans[address]; !ok {
+		return false
+	}
+	t.remove(address)
+	return true
+}
+
+// remove a ban, must hold the lock
+func (t *banTracker) remove(address string) {
+	delete(t.bans, address)
+	if t.database != nil {
+		if err := t.database.deleteBan(address); err != nil {
+			log.Errorf("bans: failed to delete ban of %s: %s", address, err)
+		}
+	}
+}
+
+// forget expired bans and failures outside of the window
+func (t *banTracker) expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for address, ban := range t.bans {
+		if ban.Expires <= now.Unix() {
+			log.Infof("bans: ban of %s expired", address)
+			t.remove(address)
+		}
+	}
+	for address, failure := range t.failures {
+		if now.Sub(failure.since) > t.settings.Window {
+			delete(t.failures, address)
+		}
+	}
+}
+
+func (t *banTracker) list() []*BanInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now().Unix()
+	bans := make([]*BanInfo, 0, len(t.bans))
+	for _, ban := range t.bans {
+		if ban.Expires <= now {
+			continue
+		}
+		bans = append(bans, &BanInfo{
+			Address:  ban.Address,
+			Failures: ban.Failures,
+			Created:  ban.Created,
+			Expires:  ban.Expires,
+		})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created < bans[j].Created })
+	return bans
+}
+
+// returns the active bans, oldest first
+func (g *Gateway) ListBans() []*BanInfo {
+	if g.bans == nil {
+		return []*BanInfo{}
+	}
+	return g.bans.list()
+}
+
+// lift the ban of an ip address or prefix in cidr notation, returns false when it was not banned
+func (g *Gateway) Unban(address string) bool {
+	if g.bans == nil {
+		return false
+	}
+	if !g.bans.unban(address) {
+		return false
+	}
+	log.Noticef("bans: unbanned %s", address)
+	return true
+}
+
+// whether the remote address of a new tcp connection is banned
+func (g *Gateway) isBanned(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if g.bans == nil || !ok {
+		return false
+	}
+	ban := g.bans.banned(tcp.IP)
+	if ban == nil {
+		return false
+	}
+	log.Infof("bans: rejecting connection from banned %s: remote = %s, expires = %s", ban.Address, addr, time.Unix(ban.Expires, 0).Format(time.RFC3339))
+	return true
+}
+
+// whether a failed handshake was a failed login, rather than a network or protocol error or
+// the client giving up before trying any key, it counts once however many keys were tried
+func isFailedLogin(err error) bool {
+	var authErr *ssh.ServerAuthError
+	if !errors.As(err, &authErr) {
+		return false
+	}
+	for _, err := range authErr.Errors {
+		if err != nil && err != ssh.ErrNoAuth {
+			return true
+		}
+	}
+	return false
+}
+
+// count a failed login of the remote address
+func (g *Gateway) authenticationFailed(addr net.Addr) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if g.bans == nil || !ok {
+		return
+	}
+	for _, ban := range g.bans.failed(tcp.IP) {
+		log.Warningf("bans: banned %s after %d failed logins, expires = %s", ban.Address, ban.Failures, time.Unix(ban.Expires, 0).Format(time.RFC3339))
+		g.events.publish(&Event{
+			Type:      EventAddressBanned,
+			Timestamp: ban.Created,
+			Address:   addr.String(),
+			Data: map[string]interface{}{
+				"banned":   ban.Address,
+				"failures": ban.Failures,
+				"expires":  ban.Expires,
+			},
+		})
+	}
+}
+
+// forget the failed logins of the remote address once it logged in and passed the access policy,
+// logins as the enroll user do not count, since it accepts any key
+func (g *Gateway) authenticationSucceeded(addr net.Addr, permissions *ssh.Permissions) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if g.bans == nil || !ok || isEnrolling(permissions) {
+		return
+	}
+	g.bans.succeeded(tcp.IP)
+}
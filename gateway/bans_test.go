@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestBanTracker(t *testing.T, settings *BanSettings) *banTracker {
+	tracker, err := newBanTracker(settings, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+// count failures of the address, returns the bans caused by the last one
+func failTimes(tracker *banTracker, ip string, times int) []*banModel {
+	var bans []*banModel
+	for i := 0; i < times; i++ {
+		bans = tracker.failed(net.ParseIP(ip))
+	}
+	return bans
+}
+
+func TestBanTrackerBansAddress(t *testing.T) {
+	tracker := newTestBanTracker(t, &BanSettings{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		Duration:    time.Hour,
+	})
+
+	if bans := failTimes(tracker, "192.0.2.1", 2); len(bans) != 0 {
+		t.Fatalf("banned before reaching the limit: %v", bans)
+	}
+	if bans := failTimes(tracker, "192.0.2.1", 1); len(bans) != 1 || bans[0].Address != "192.0.2.1" {
+		t.Fatalf("expected the address to be banned, got %v", bans)
+	}
+	if tracker.banned(net.ParseIP("192.0.2.1")) == nil {
+		t.Fatal("banned address was not reported as banned")
+	}
+	if tracker.banned(net.ParseIP("192.0.2.2")) != nil {
+		t.Fatal("other address of the prefix was banned")
+	}
+}
+
+func TestBanTrackerWindow(t *testing.T) {
+	tracker := newTestBanTracker(t, &BanSettings{
+		MaxFailures: 3,
+		Window:      50 * time.Millisecond,
+		Duration:    time.Hour,
+	})
+
+	failTimes(tracker, "192.0.2.1", 2)
+	time.Sleep(100 * time.Millisecond)
+	if bans := failTimes(tracker, "192.0.2.1", 2); len(bans) != 0 {
+		t.Fatalf("failures of a previous window were counted: %v", bans)
+	}
+	if bans := failTimes(tracker, "192.0.2.1", 1); len(bans) != 1 {
+		t.Fatalf("expected the address to be banned within the new window, got %v", bans)
+	}
+
+	failTimes(tracker, "192.0.2.9", 1)
+	time.Sleep(100 * time.Millisecond)
+	tracker.expire()
+	if _, ok := tracker.failures["192.0.2.9"]; ok {
+		t.Fatal("failures outside of the window were not expired")
+	}
+}
+
+func TestBanTrackerPrefix(t *testing.T) {
+	tracker := newTestBanTracker(t, &BanSettings{
+		MaxFailures:       10,
+		MaxPrefixFailures: 3,
+		Window:            time.Minute,
+		Duration:          time.Hour,
+	})
+
+	failTimes(tracker, "192.0.2.1", 1)
+	failTimes(tracker, "192.0.2.2", 1)
+	failTimes(tracker, "198.51.100.1", 1)
+	bans := failTimes(tracker, "192.0.2.3", 1)
+	if len(bans) != 1 || bans[0].Address != "192.0.2.0/24" {
+		t.Fatalf("expected the prefix to be banned, got %v", bans)
+	}
+	if tracker.banned(net.ParseIP("192.0.2.200")) == nil {
+		t.Fatal("address in the banned prefix was not reported as banned")
+	}
+	if tracker.banned(net.ParseIP("198.51.100.1")) != nil {
+		t.Fatal("address outside of the prefix was banned")
+	}
+
+	failTimes(tracker, "2001:db8:0:1::1", 1)
+	failTimes(tracker, "2001:db8:0:1::2", 1)
+	bans = failTimes(tracker, "2001:db8:0:1:ffff::3", 1)
+	if len(bans) != 1 || bans[0].Address != "2001:db8:0:1::/64" {
+		t.Fatalf("expected the ipv6 prefix to be banned, got %v", bans)
+	}
+}
+
+func TestBanTrackerSucceeded(t *testing.T) {
+	tracker := newTestBanTracker(t, &BanSettings{
+		MaxFailures:       3,
+		MaxPrefixFailures: 4,
+		Window:            time.Minute,
+		Duration:          time.Hour,
+	})
+
+	failTimes(tracker, "192.0.2.1", 2)
+	tracker.succeeded(net.ParseIP("192.0.2.1"))
+	if bans := failTimes(tracker, "192.0.2.1", 1); len(bans) != 0 {
+		t.Fatalf("failures before the login were still counted: %v", bans)
+	}
+
+	// the prefix keeps counting, 4 failures so far
+	bans := failTimes(tracker, "192.0.2.1", 1)
+	if len(bans) != 1 || bans[0].Address != "192.0.2.0/24" {
+		t.Fatalf("expected the prefix to be banned, got %v", bans)
+	}
+}
+
+func TestEnrollLoginKeepsFailures(t *testing.T) {
+	tracker := newTestBanTracker(t, &BanSettings{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		Duration:    time.Hour,
+	})
+	g := &Gateway{
+		bans: tracker,
+	}
+	addr := &net.TCPAddr{
+		IP:   net.ParseIP("192.0.2.1"),
+		Port: 50000,
+	}
+
+	failTimes(tracker, "192.0.2.1", 2)
+	g.authenticationSucceeded(addr, &ssh.Permissions{
+		Extensions: map[string]string{
+			extensionEnroll: "",
+		},
+	})
+	if bans := failTimes(tracker, "192.0.2.1", 1); len(bans) != 1 {
+		t.Fatalf("enroll login cleared the failures of the address, got %v", bans)
+	}
+
+	tracker.unban("192.0.2.1")
+	failTimes(tracker, "192.0.2.1", 2)
+	g.authenticationSucceeded(addr, &ssh.Permissions{})
+	if bans := failTimes(tracker, "192.0.2.1", 1); len(bans) != 0 {
+		t.Fatalf("login did not clear the failures of the address, got %v", bans)
+	}
+}
@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrNoSigningKey      = errors.New("gatewaysshd: no certificate signing key")
+	ErrUnknownSigningKey = errors.New("gatewaysshd: signing key is not one of the certificate authorities")
+	ErrNotDueForRenewal  = errors.New("gatewaysshd: certificate is not due for renewal")
+	ErrNotIssuedHere     = errors.New("gatewaysshd: certificate was not issued by the gateway")
+)
+
+const (
+	// how long issued certificates are valid by default
+	defaultCertificateValidity = 7 * 24 * time.Hour
+
+	// issued certificates are valid slightly in the past to tolerate clock skew
+	certificateClockSkew = 5 * time.Minute
+
+	// how long before expiry certificates can be renewed by default
+	defaultRenewalWindow = 72 * time.Hour
+)
+
+// options of a certificate issued by the gateway
+type CertificateOptions struct {
+	// grants the user access to all services
+	Admin bool
+
+	// how long the certificate is valid, zero uses the configured validity
+	Validity time.Duration
+}
+
+// signs user certificates with a certificate authority key held by the gateway
+type certificateAuthority struct {
+	signer     ssh.Signer
+	validity   time.Duration
+	extensions map[string]string
+}
+
+func newCertificateAuthority(signer ssh.Signer, validity time.Duration, extensions map[string]string) *certificateAuthority {
+	if validity <= 0 {
+		validity = defaultCertificateValidity
+	}
+	if extensions == nil {
+		extensions = map[string]string{
+			"permit-pty": "",
+		}
+	}
+	return &certificateAuthority{
+		signer:     signer,
+		validity:   validity,
+		extensions: extensions,
+	}
+}
+
+// the extensions of a certificate issued with the options
+func (a *certificateAuthority) extensionsFor(options *CertificateOptions) map[string]string {
+	extensions := make(map[string]string, len(a.extensions)+1)
+	for name, value := range a.extensions {
+		extensions[name] = value
+	}
+	if options != nil && options.Admin {
+		extensions["permit-port-forwarding"] = ""
+	}
+	return extensions
+}
+
+// the validity of a certificate issued with the options
+func (a *certificateAuthority) validityFor(options *CertificateOptions) time.Duration {
+	if options != nil && options.Validity > 0 {
+		return options.Validity
+	}
+	return a.validity
+}
+
+// a certificate to be signed, the signed certificate is set once it is recorded
+type certificateRequest struct {
+	authority       *certificateAuthority
+	key             ssh.PublicKey
+	keyID           string
+	principals      []string
+	criticalOptions map[string]string
+	extensions      map[string]string
+	validity        time.Duration
+
+	// why and for whom the certificate is issued, for auditing
+	reason  string
+	address string
+
+	certificate *ssh.Certificate
+}
+
+// sign the certificate with the allocated serial, returns its audit record
+func (r *certificateRequest) sign(serial uint64) (*certificateModel, error) {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             r.key,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           r.keyID,
+		ValidPrincipals: r.principals,
+		ValidAfter:      uint64(now.Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(r.validity).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: r.criticalOptions,
+			Extensions:      r.extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, r.authority.signer); err != nil {
+		return nil, err
+	}
+	r.certificate = cert
+
+	return &certificateModel{
+		Serial:      serial,
+		KeyID:       cert.KeyId,
+		Principals:  cert.ValidPrincipals,
+		Fingerprint: ssh.FingerprintSHA256(r.key),
+		Extensions:  cert.Extensions,
+		ValidAfter:  int64(cert.ValidAfter),
+		ValidBefore: int64(cert.ValidBefore),
+		Certificate: string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(cert))),
+		Issued:      now.Unix(),
+		Reason:      r.reason,
+		Address:     r.address,
+	}, nil
+}
+
+func (m *certificateModel) info() *IssuedCertificateInfo {
+	return &IssuedCertificateInfo{
+		Serial:      m.Serial,
+		KeyID:       m.KeyID,
+		Principals:  m.Principals,
+		Fingerprint: m.Fingerprint,
+		Extensions:  m.Extensions,
+		ValidAfter:  m.ValidAfter,
+		ValidBefore: m.ValidBefore,
+		Issued:      m.Issued,
+		Reason:      m.Reason,
+		Address:     m.Address,
+	}
+}
+
+// create a one-time token that has a certificate issued for the principal to whoever uses it,
+// by running "ssh enroll@gateway <token>" before the token expires
+func (g *Gateway) CreateCertificateToken(principal string, validity time.Duration, options *CertificateOptions) (string, error) {
+	if g.authority == nil {
+		return "", ErrNoSigningKey
+	}
+
+	enrollment := &enrollmentModel{
+		User:        principal,
+		Certificate: true,
+	}
+	if options != nil {
+		enrollment.Admin = options.Admin
+		enrollment.Validity = int64(options.Validity / time.Second)
+	}
+	token, err := g.createEnrollmentToken(enrollment, validity)
+	if err != nil {
+		return "", err
+	}
+	log.Noticef("certificate token created: principal = %s, admin = %v, expires = %s", principal, enrollment.Admin, time.Unix(enrollment.Expires, 0).Format(time.RFC3339))
+	return token, nil
+}
+
+// list certificates issued by the gateway, of a principal or of all when principal is empty
+func (g *Gateway) ListCertificates(principal string) ([]*IssuedCertificateInfo, error) {
+	if g.database == nil {
+		return nil, ErrNoDatabase
+	}
+
+	models, err := g.database.listCertificates(principal)
+	if err != nil {
+		return nil, err
+	}
+	certificates := make([]*IssuedCertificateInfo, 0, len(models))
+	for _, model := range models {
+		certificates = append(certificates, model.info())
+	}
+	return certificates, nil
+}
+
+// how long before expiry certificates can be renewed, and are warned about
+func (g *Gateway) renewalWindow() time.Duration {
+	if g.settings.RenewalWindow > 0 {
+		return g.settings.RenewalWindow
+	}
+	return defaultRenewalWindow
+}
+
+// whether the certificate expires within the renewal window, certificates valid forever never do
+func (g *Gateway) expiresSoon(cert *ssh.Certificate) bool {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return false
+	}
+	return time.Until(time.Unix(int64(cert.ValidBefore), 0)) < g.renewalWindow()
+}
+
+// issue a fresh certificate for the same key, key id, principals and critical options,
+// when the certificate the user logged in with was signed by the gateway and expires within
+// the renewal window, the extensions are those the gateway issues now, and the validity
+// is no longer than that of the current certificate
+func (g *Gateway) renewCertificate(user string, cert *ssh.Certificate, address string) (*ssh.Certificate, error) {
+	if g.authority == nil {
+		return nil, ErrNoSigningKey
+	}
+	if g.database == nil {
+		return nil, ErrNoDatabase
+	}
+
+	// certificates of other authorities may carry permissions the gateway would not grant
+	if !bytes.Equal(cert.SignatureKey.Marshal(), g.authority.signer.PublicKey().Marshal()) {
+		return nil, ErrNotIssuedHere
+	}
+
+	// the certificate may have been revoked since the user logged in
+	if err := g.certificates.checkCertificate(user, cert); err != nil {
+		return nil, err
+	}
+	if !g.expiresSoon(cert) {
+		return nil, ErrNotDueForRenewal
+	}
+
+	_, admin := cert.Extensions["permit-port-forwarding"]
+	options := &CertificateOptions{
+		Admin:    admin,
+		Validity: g.authority.validity,
+	}
+	if lifetime := time.Duration(cert.ValidBefore-cert.ValidAfter)*time.Second - certificateClockSkew; lifetime > 0 && lifetime < options.Validity {
+		options.Validity = lifetime
+	}
+
+	request := &certificateRequest{
+		authority:       g.authority,
+		key:             cert.Key,
+		keyID:           cert.KeyId,
+		principals:      cert.ValidPrincipals,
+		criticalOptions: cert.CriticalOptions,
+		extensions:      g.authority.extensionsFor(options),
+		validity:        g.authority.validityFor(options),
+		reason:          "renewal",
+		address:         address,
+	}
+	if err := g.database.recordCertificate(request.sign); err != nil {
+		return nil, err
+	}
+
+	renewed := request.certificate
+	log.Noticef("certificate renewed: key_id = %s, serial = %d, previous_serial = %d, remote = %s, valid_before = %s", renewed.KeyId, renewed.Serial, cert.Serial, address, time.Unix(int64(renewed.ValidBefore), 0).Format(time.RFC3339))
+	return renewed, nil
+}
+
+// format a certificate timestamp, which may be infinity
+func formatCertificateTime(timestamp uint64) string {
+	if timestamp == ssh.CertTimeInfinity {
+		return "forever"
+	}
+	return time.Unix(int64(timestamp), 0).Format(time.RFC3339)
+}
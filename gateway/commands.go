@@ -0,0 +1,750 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// returned by a command when it is invoked with invalid arguments
+var errUsage = errors.New("gatewaysshd: invalid usage")
+
+// a built-in command that can be executed in a session
+type command struct {
+	usage      string
+	summary    string
+	admin      bool
+	enrollment bool
+	run        func(*Session, []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help": {
+			usage:      "help",
+			summary:    "list available commands",
+			enrollment: true,
+			run:        (*Session).help,
+		},
+		"ping": {
+			usage:   "ping",
+			summary: "check that the gateway is responsive",
+			run:     (*Session).ping,
+		},
+		"status": {
+			usage:   "status",
+			summary: "dump the status of this connection, or the whole gateway for admins",
+			run:     (*Session).status,
+		},
+		"reportStatus": {
+			usage:   "reportStatus < status.json.gz",
+			summary: "report the status of this device as gzipped json on stdin",
+			run:     (*Session).reportStatus,
+		},
+		"users": {
+			usage:   "users",
+			summary: "list known users, online or not",
+			admin:   true,
+			run:     (*Session).users,
+		},
+		"services": {
+			usage:   "services [--json|--table] [pattern]",
+			summary: "list online services you can reach, optionally filtered by a glob pattern",
+			run:     (*Session).services,
+		},
+		"tunnels": {
+			usage:   "tunnels",
+			summary: "list active tunnels",
+			run:     (*Session).tunnels,
+		},
+		"kill": {
+			usage:   "kill <connection-id> [reason]",
+			summary: "disconnect a connection",
+			admin:   true,
+			run:     (*Session).kill,
+		},
+		"kill-user": {
+			usage:   "kill-user <user> [reason]",
+			summary: "disconnect all connections of a user",
+			admin:   true,
+			run:     (*Session).killUser,
+		},
+		"close-tunnel": {
+			usage:   "close-tunnel <tunnel-id> [reason]",
+			summary: "close a tunnel",
+			admin:   true,
+			run:     (*Session).closeTunnel,
+		},
+		"watch": {
+			usage:   "watch [--user <pattern>]... [<event-type-pattern>]...",
+			summary: "stream gateway events as they happen, press q to stop on a terminal",
+			admin:   true,
+			run:     (*Session).watch,
+		},
+		"revoke": {
+			usage:   "revoke <key-id>|<serial>|<key-id>/<serial>",
+			summary: "add a certificate to the revocation list",
+			admin:   true,
+			run:     (*Session).revoke,
+		},
+		"reload": {
+			usage:   "reload",
+			summary: "re-read certificate authorities, host certificate and host key, existing connections are not affected",
+			admin:   true,
+			run:     (*Session).reload,
+		},
+		"bans": {
+			usage:   "bans",
+			summary: "list addresses banned for failing to authenticate",
+			admin:   true,
+			run:     (*Session).bans,
+		},
+		"unban": {
+			usage:   "unban <address>|<prefix>|all",
+			summary: "lift the ban of an address or prefix, or of all of them",
+			admin:   true,
+			run:     (*Session).unban,
+		},
+		"keys": {
+			usage:   "keys [user]",
+			summary: "list public keys enrolled in the database",
+			admin:   true,
+			run:     (*Session).keys,
+		},
+		"add-key": {
+			usage:   "add-key [--label <label>] [--admin] [--expires <duration>] <user> <public-key>",
+			summary: "add a public key a user may log in with",
+			admin:   true,
+			run:     (*Session).addKey,
+		},
+		"delete-key": {
+			usage:   "delete-key <user> <fingerprint>",
+			summary: "delete a public key, existing connections are not affected",
+			admin:   true,
+			run:     (*Session).deleteKey,
+		},
+		"enroll-token": {
+			usage:   "enroll-token [--label <label>] [--admin] [--expires <duration>] [--validity <duration>] <user>",
+			summary: "create a one-time token to enroll a key for a user, valid for 24h by default",
+			admin:   true,
+			run:     (*Session).enrollToken,
+		},
+		"cert-token": {
+			usage:   "cert-token [--admin] [--validity <duration>] [--cert-validity <duration>] <principal>",
+			summary: "create a one-time token to issue a certificate for a principal, valid for 24h by default",
+			admin:   true,
+			run:     (*Session).certificateToken,
+		},
+		"certificates": {
+			usage:   "certificates [principal]",
+			summary: "list certificates issued by the gateway",
+			admin:   true,
+			run:     (*Session).certificates,
+		},
+		"renew": {
+			usage:   "renew > certificate.pub",
+			summary: "get a fresh certificate for the key you logged in with, when it is about to expire",
+			run:     (*Session).renew,
+		},
+		"enroll": {
+			usage:      "enroll <token>",
+			summary:    "enroll the key you logged in with using a one-time token, or get a certificate for it",
+			enrollment: true,
+			run:        (*Session).enroll,
+		},
+	}
+}
+
+func (s *Session) help(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+
+	header := []string{"COMMAND", "DESCRIPTION"}
+	rows := make([][]string, 0, len(commands))
+	result := make([]map[string]interface{}, 0, len(commands))
+	for _, name := range s.commandNames() {
+		rows = append(rows, []string{commands[name].usage, commands[name].summary})
+		result = append(result, map[string]interface{}{
+			"command": name,
+			"usage":   commands[name].usage,
+			"summary": commands[name].summary,
+		})
+	}
+	return s.render(result, header, rows)
+}
+
+func (s *Session) users(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+
+	users, err := s.connection.gateway.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	header := []string{"USER", "CONNECTIONS", "ADDRESS", "COUNTRY", "LAST USED"}
+	rows := make([][]string, 0, len(users))
+	for _, user := range users {
+		country := ""
+		if user.Location != nil {
+			country = user.Location.Country
+		}
+		rows = append(rows, []string{
+			user.ID,
+			strconv.Itoa(user.ConnectionsCount),
+			user.Address,
+			country,
+			formatTime(user.Used),
+		})
+	}
+	return s.render(users, header, rows)
+}
+
+func (s *Session) services(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	pattern := "*"
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errUsage
+	}
+
+	services := make([]*ServiceInfo, 0)
+	for _, connection := range s.connection.gateway.Connections() {
+		if !s.connection.permitTunnel(connection) {
+			continue
+		}
+		for _, service := range connection.gatherServices() {
+			if ok, _ := path.Match(pattern, service.Name); ok {
+				services = append(services, service)
+			}
+		}
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	header := []string{"SERVICE", "PORTS", "CONNECTION", "UP TIME", "TUNNELS"}
+	rows := make([][]string, 0, len(services))
+	for _, service := range services {
+		ports := make([]string, 0)
+		for _, port := range service.Ports {
+			ports = append(ports, strconv.Itoa(int(port)))
+		}
+		rows = append(rows, []string{
+			service.Name,
+			strings.Join(ports, ","),
+			service.Connection,
+			formatDuration(service.UpTime),
+			strconv.Itoa(service.TunnelsCount),
+		})
+	}
+	return s.render(services, header, rows)
+}
+
+func (s *Session) tunnels(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+
+	// non-admin users can only see their own tunnels
+	connections := []*Connection{s.connection}
+	if s.connection.admin {
+		connections = s.connection.gateway.Connections()
+	}
+
+	header := []string{"TUNNEL", "CONNECTION", "USER", "TYPE", "SERVICE", "PEER", "ORIGIN"}
+	var rows [][]string
+	result := make([]*TunnelInfo, 0)
+	for _, connection := range connections {
+		for _, tunnel := range connection.Tunnels() {
+			service, peer := tunnel.describe()
+			rows = append(rows, []string{
+				tunnel.id,
+				connection.id,
+				connection.user,
+				tunnel.channelType,
+				service,
+				peer,
+				tunnel.metadata.origin,
+			})
+			result = append(result, tunnel.gatherStatus())
+		}
+	}
+	return s.render(result, header, rows)
+}
+
+func (s *Session) kill(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	if !s.connection.gateway.KillConnection(args[0], s.reason(args[1:])) {
+		return commandFailed(exitFailure, "connection not found: %s", args[0])
+	}
+
+	_, err := fmt.Fprintf(s.stdout, "disconnected %s\n", args[0])
+	return err
+}
+
+func (s *Session) killUser(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	count := s.connection.gateway.KillUser(args[0], s.reason(args[1:]))
+	if count == 0 {
+		return commandFailed(exitFailure, "user not connected: %s", args[0])
+	}
+
+	_, err := fmt.Fprintf(s.stdout, "disconnected %d connection(s) of %s\n", count, args[0])
+	return err
+}
+
+func (s *Session) closeTunnel(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	if !s.connection.gateway.CloseTunnel(args[0], s.reason(args[1:])) {
+		return commandFailed(exitFailure, "tunnel not found: %s", args[0])
+	}
+
+	_, err := fmt.Fprintf(s.stdout, "closed %s\n", args[0])
+	return err
+}
+
+func (s *Session) watch(args []string) error {
+	var types, users []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--user" || args[i] == "-u" {
+			if i+1 >= len(args) {
+				return errUsage
+			}
+			users = append(users, args[i+1])
+			i++
+			continue
+		}
+		types = append(types, args[i])
+	}
+	filter, err := NewEventFilter(types, users)
+	if err != nil {
+		return errUsage
+	}
+
+	subscription := s.connection.gateway.Subscribe(filter)
+	defer subscription.Close()
+
+	// on a terminal, stop watching when ctrl-c, ctrl-d or q is pressed
+	stopped := make(chan struct{})
+	if s.pty != nil {
+		go func() {
+			defer close(stopped)
+			buffer := make([]byte, 1)
+			for {
+				if _, err := s.channel.Read(buffer); err != nil {
+					return
+				}
+				switch buffer[0] {
+				case 3, 4, 'q':
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return nil
+			}
+			if dropped := subscription.TakeDropped(); dropped > 0 {
+				if err := s.writeEvent(newDroppedEvent(dropped)); err != nil {
+					return err
+				}
+			}
+			if err := s.writeEvent(event); err != nil {
+				return err
+			}
+		case <-stopped:
+			return nil
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// write an event as a line of json, or as a human readable line on a terminal
+func (s *Session) writeEvent(event *Event) error {
+	if !s.table {
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = s.stdout.Write(append(encoded, '\n'))
+		return err
+	}
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.stdout, "%s  %-20s  %s  %s  %s\n", formatTime(event.Timestamp), event.Type, event.User, event.Address, data)
+	return err
+}
+
+// the reason given to an admin command, attributed to the admin
+func (s *Session) reason(args []string) string {
+	reason := "closed by administrator"
+	if len(args) > 0 {
+		reason = strings.Join(args, " ")
+	}
+	return fmt.Sprintf("%s (by %s)", reason, s.connection.user)
+}
+
+func (s *Session) revoke(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	if err := s.connection.gateway.revoke(args[0]); err != nil {
+		return err
+	}
+	log.Noticef("revocation requested: user = %s, remote = %v, entry = %s", s.connection.user, s.connection.remoteAddr, args[0])
+
+	_, err := fmt.Fprintf(s.stdout, "revoked %s, existing connections are not affected\n", args[0])
+	return err
+}
+
+func (s *Session) reload(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+
+	reload := s.connection.gateway.settings.ReloadFunc
+	if reload == nil {
+		return commandFailed(exitFailure, "reload is not supported")
+	}
+	log.Noticef("reload requested: user = %s, remote = %v", s.connection.user, s.connection.remoteAddr)
+	if err := reload(); err != nil {
+		log.Errorf("failed to reload, keeping the current configuration: %s", err)
+		return commandFailed(exitFailure, "reload failed, keeping the current configuration: %s", err)
+	}
+
+	_, err := fmt.Fprintf(s.stdout, "reloaded, existing connections are not affected\n")
+	return err
+}
+
+func (s *Session) bans(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+
+	bans := s.connection.gateway.ListBans()
+	header := []string{"ADDRESS", "FAILURES", "CREATED", "EXPIRES"}
+	rows := make([][]string, 0, len(bans))
+	for _, ban := range bans {
+		rows = append(rows, []string{
+			ban.Address,
+			strconv.Itoa(ban.Failures),
+			formatTime(ban.Created),
+			formatTime(ban.Expires),
+		})
+	}
+	return s.render(bans, header, rows)
+}
+
+func (s *Session) unban(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	addresses := []string{args[0]}
+	if args[0] == "all" {
+		addresses = addresses[:0]
+		for _, ban := range s.connection.gateway.ListBans() {
+			addresses = append(addresses, ban.Address)
+		}
+	}
+	log.Noticef("unban requested: user = %s, remote = %v, address = %s", s.connection.user, s.connection.remoteAddr, args[0])
+
+	count := 0
+	for _, address := range addresses {
+		if s.connection.gateway.Unban(address) {
+			count++
+		}
+	}
+	if count == 0 && args[0] != "all" {
+		return commandFailed(exitFailure, "not banned: %s", args[0])
+	}
+
+	_, err := fmt.Fprintf(s.stdout, "lifted %d bans\n", count)
+	return err
+}
+
+func (s *Session) keys(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	user := ""
+	if len(args) > 0 {
+		user = args[0]
+	}
+	keys, err := s.connection.gateway.ListKeys(user)
+	if err != nil {
+		return err
+	}
+
+	header := []string{"USER", "FINGERPRINT", "LABEL", "ADMIN", "CREATED", "EXPIRES", "LAST USED"}
+	rows := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, []string{
+			key.User,
+			key.Fingerprint,
+			key.Label,
+			strconv.FormatBool(key.Admin),
+			formatTime(key.Created),
+			formatTime(key.Expires),
+			formatTime(key.LastUsed),
+		})
+	}
+	return s.render(keys, header, rows)
+}
+
+func (s *Session) addKey(args []string) error {
+	options, _, args, err := parseKeyOptions(args)
+	if err != nil || len(args) < 2 {
+		return errUsage
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(args[1:], " ")))
+	if err != nil {
+		return commandFailed(exitDataError, "invalid public key: %s", err)
+	}
+
+	info, err := s.connection.gateway.AddKey(args[0], key, options)
+	if err != nil {
+		return commandFailed(exitFailure, "failed to add key: %s", err)
+	}
+
+	_, err = fmt.Fprintf(s.stdout, "added %s for %s\n", info.Fingerprint, info.User)
+	return err
+}
+
+func (s *Session) deleteKey(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+
+	deleted, err := s.connection.gateway.DeleteKey(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return commandFailed(exitFailure, "key not found: %s", args[1])
+	}
+
+	_, err = fmt.Fprintf(s.stdout, "deleted %s, existing connections are not affected\n", args[1])
+	return err
+}
+
+func (s *Session) enrollToken(args []string) error {
+	options, validity, args, err := parseKeyOptions(args)
+	if err != nil || len(args) != 1 {
+		return errUsage
+	}
+
+	token, err := s.connection.gateway.CreateEnrollmentToken(args[0], validity, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.stdout, "%s\n", token)
+	return err
+}
+
+func (s *Session) certificateToken(args []string) error {
+	options := &CertificateOptions{}
+	validity := 24 * time.Hour
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--admin":
+			options.Admin = true
+		case "--validity", "--cert-validity":
+			if i+1 >= len(args) {
+				return errUsage
+			}
+			duration, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return errUsage
+			}
+			if args[i] == "--validity" {
+				validity = duration
+			} else {
+				options.Validity = duration
+			}
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if len(rest) != 1 {
+		return errUsage
+	}
+
+	token, err := s.connection.gateway.CreateCertificateToken(rest[0], validity, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.stdout, "%s\n", token)
+	return err
+}
+
+func (s *Session) certificates(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	principal := ""
+	if len(args) > 0 {
+		principal = args[0]
+	}
+	certificates, err := s.connection.gateway.ListCertificates(principal)
+	if err != nil {
+		return err
+	}
+
+	header := []string{"SERIAL", "KEY ID", "PRINCIPALS", "FINGERPRINT", "ISSUED", "VALID BEFORE", "REASON", "ADDRESS"}
+	rows := make([][]string, 0, len(certificates))
+	for _, certificate := range certificates {
+		rows = append(rows, []string{
+			strconv.FormatUint(certificate.Serial, 10),
+			certificate.KeyID,
+			strings.Join(certificate.Principals, ","),
+			certificate.Fingerprint,
+			formatTime(certificate.Issued),
+			formatTime(certificate.ValidBefore),
+			certificate.Reason,
+			certificate.Address,
+		})
+	}
+	return s.render(certificates, header, rows)
+}
+
+// redeem a one-time token, a certificate is written to stdout in authorized keys format
+// so that it can be saved next to the private key, such as id_ed25519-cert.pub
+func (s *Session) enroll(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if s.connection.publicKey == nil {
+		return commandFailed(exitFailure, "no public key to enroll")
+	}
+
+	info, cert, err := s.connection.gateway.enroll(args[0], s.connection.publicKey, s.connection.remoteAddr.String())
+	if err != nil {
+		log.Warningf("enrollment failed: remote = %v, error = %s", s.connection.remoteAddr, err)
+		return commandFailed(exitPermissionDenied, "enrollment failed: %s", err)
+	}
+
+	if cert != nil {
+		_, err = s.stdout.Write(ssh.MarshalAuthorizedKey(cert))
+		return err
+	}
+	_, err = fmt.Fprintf(s.stdout, "enrolled %s, log in as %s from now on\n", info.Fingerprint, info.User)
+	return err
+}
+
+// issue a fresh certificate in authorized keys format on stdout, which should be written
+// to a new file first, since the current one is still used by the ssh client
+func (s *Session) renew(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	if s.connection.certificate == nil {
+		return commandFailed(exitFailure, "not logged in with a certificate")
+	}
+
+	renewed, err := s.connection.gateway.renewCertificate(s.connection.user, s.connection.certificate, s.connection.remoteAddr.String())
+	if err == ErrNotDueForRenewal {
+		return commandFailed(exitFailure, "certificate is not due for renewal until %s", time.Unix(s.connection.certificateExpires(), 0).Add(-s.connection.gateway.renewalWindow()).Format(time.RFC3339))
+	}
+	if err == ErrNotIssuedHere {
+		return commandFailed(exitFailure, "only certificates issued by the gateway can be renewed")
+	}
+	if err != nil {
+		log.Warningf("certificate renewal failed: user = %s, remote = %v, error = %s", s.connection.user, s.connection.remoteAddr, err)
+		return commandFailed(exitFailure, "renewal failed: %s", err)
+	}
+
+	_, err = s.stdout.Write(ssh.MarshalAuthorizedKey(renewed))
+	return err
+}
+
+// parse the options of add-key and enroll-token, returns the remaining arguments
+func parseKeyOptions(args []string) (*KeyOptions, time.Duration, []string, error) {
+	options := &KeyOptions{}
+	validity := 24 * time.Hour
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--admin":
+			options.Admin = true
+		case "--label", "--expires", "--validity":
+			if i+1 >= len(args) {
+				return nil, 0, nil, errUsage
+			}
+			value := args[i+1]
+			switch args[i] {
+			case "--label":
+				options.Label = value
+			case "--expires":
+				duration, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, 0, nil, err
+				}
+				options.Expires = time.Now().Add(duration)
+			case "--validity":
+				duration, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, 0, nil, err
+				}
+				validity = duration
+			}
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return options, validity, rest, nil
+}
+
+func formatDuration(seconds uint64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func formatTime(timestamp int64) string {
+	if timestamp == 0 {
+		return ""
+	}
+	return time.Unix(timestamp, 0).Format(time.RFC3339)
+}
@@ -3,8 +3,11 @@ package gateway
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/segmentio/ksuid"
@@ -28,22 +31,20 @@ type Connection struct {
 	sessionsClosed uint64
 	tunnels        []*Tunnel
 	tunnelsClosed  uint64
-	services       map[string]map[uint16]bool
+	services       map[string]map[uint16]time.Time
 	lock           *sync.Mutex
 	closeOnce      sync.Once
 	usage          *usageStats
 	admin          bool
+	enrolling      bool
+	publicKey      ssh.PublicKey
+	certificate    *ssh.Certificate
 	status         json.RawMessage
-	location       map[string]interface{}
+	location       *Location
 }
 
-func newConnection(gateway *Gateway, conn *ssh.ServerConn, usage *usageStats, location map[string]interface{}) *Connection {
-	log.Infof("new connection: user = %s, remote = %v, location = %v", conn.User(), conn.RemoteAddr(), location)
-
-	admin := true
-	if _, ok := conn.Permissions.Extensions["permit-port-forwarding"]; !ok {
-		admin = false
-	}
+func newConnection(gateway *Gateway, conn *ssh.ServerConn, usage *usageStats, location *Location) *Connection {
+	log.Infof("new connection: user = %s, remote = %v, location = %+v", conn.User(), conn.RemoteAddr(), location)
 
 	connection := &Connection{
 		id:         ksuid.New().String(),
@@ -52,15 +53,76 @@ func newConnection(gateway *Gateway, conn *ssh.ServerConn, usage *usageStats, lo
 		user:       conn.User(),
 		remoteAddr: conn.RemoteAddr(),
 		localAddr:  conn.LocalAddr(),
-		services:   make(map[string]map[uint16]bool),
+		services:   make(map[string]map[uint16]time.Time),
 		lock:       &sync.Mutex{},
 		usage:      usage,
-		admin:      admin,
+		admin:      isAdmin(conn.Permissions),
+		enrolling:  isEnrolling(conn.Permissions),
+		publicKey:  permittedPublicKey(conn.Permissions),
 		location:   location,
 	}
+
+	// the certificate the user logged in with, if any
+	if cert, ok := connection.publicKey.(*ssh.Certificate); ok {
+		connection.certificate = cert
+		log.Infof("connection certificate: id = %s, key_id = %s, serial = %d, principals = %v, valid_before = %s, ca = %s, fingerprint = %s", connection.id, cert.KeyId, cert.Serial, cert.ValidPrincipals, formatCertificateTime(cert.ValidBefore), ssh.FingerprintSHA256(cert.SignatureKey), connection.fingerprint())
+	} else if connection.publicKey != nil {
+		log.Infof("connection key: id = %s, fingerprint = %s", connection.id, connection.fingerprint())
+		gateway.keyUsed(connection.user, connection.publicKey)
+	}
+	for _, warning := range connection.warnings() {
+		log.Warningf("connection warning: user = %s, remote = %v, warning = %s", connection.user, connection.remoteAddr, warning)
+	}
 	return connection
 }
 
+// how long a client is given to take the reason it is disconnected
+const disconnectTimeout = 1 * time.Second
+
+// notify the client with the reason, then close the ssh connection
+func (c *Connection) Disconnect(reason string) {
+	log.Noticef("disconnecting: id = %s, user = %s, remote = %v, reason = %s", c.id, c.user, c.remoteAddr, reason)
+
+	// a client that stopped reading blocks writes to it, so it is closed without waiting for too long
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+
+		// tell interactive clients why they are being disconnected
+		for _, session := range c.Sessions() {
+			session.notify(fmt.Sprintf("disconnected: %s", reason))
+		}
+
+		// clients that understand it can pick up the reason from a global request
+		if _, _, err := c.conn.SendRequest("disconnect@gatewaysshd", false, marshalDisconnectRequest(&disconnectRequest{
+			Reason: reason,
+		})); err != nil {
+			log.Debugf("failed to send disconnect request: %s", err)
+		}
+	}()
+	select {
+	case <-notified:
+	case <-time.After(disconnectTimeout):
+		log.Warningf("disconnecting without the client taking the reason: id = %s, user = %s, remote = %v", c.id, c.user, c.remoteAddr)
+	}
+
+	c.Close()
+}
+
+// tell the client that the gateway is shutting down, and when its tunnels will be closed
+func (c *Connection) notifyShutdown(timeout time.Duration) {
+	for _, session := range c.Sessions() {
+		session.notify(fmt.Sprintf("gateway is shutting down, open tunnels are closed in %s", timeout))
+	}
+
+	// clients that understand it can reconnect elsewhere before they are disconnected
+	if _, _, err := c.conn.SendRequest("shutdown@gatewaysshd", false, marshalShutdownRequest(&shutdownRequest{
+		Timeout: uint32(timeout / time.Second),
+	})); err != nil {
+		log.Debugf("failed to send shutdown request: %s", err)
+	}
+}
+
 // close the ssh connection
 func (c *Connection) Close() {
 	c.closeOnce.Do(func() {
@@ -129,6 +191,8 @@ func (c *Connection) addTunnel(t *Tunnel) {
 	defer c.lock.Unlock()
 
 	c.tunnels = append([]*Tunnel{t}, c.tunnels...)
+
+	c.gateway.events.publish(newConnectionEvent(EventTunnelOpened, c, t.gatherStatus()))
 }
 
 func (c *Connection) deleteTunnel(t *Tunnel) {
@@ -144,6 +208,8 @@ func (c *Connection) deleteTunnel(t *Tunnel) {
 	}
 	c.tunnels = tunnels
 	c.tunnelsClosed += 1
+
+	c.gateway.events.publish(newConnectionEvent(EventTunnelClosed, c, t.gatherStatus()))
 }
 
 // returns the last used time of the connection
@@ -161,10 +227,8 @@ func (c *Connection) Services() map[string][]uint16 {
 
 	services := make(map[string][]uint16)
 	for host, ports := range c.services {
-		for port, ok := range ports {
-			if ok {
-				services[host] = append(services[host], port)
-			}
+		for port := range ports {
+			services[host] = append(services[host], port)
 		}
 	}
 
@@ -176,62 +240,147 @@ func (c *Connection) reportStatus(status json.RawMessage) {
 	defer c.lock.Unlock()
 
 	c.status = status
+
+	c.gateway.events.publish(newConnectionEvent(EventStatusReported, c, nil))
 }
 
-func (c *Connection) gatherStatus() map[string]interface{} {
+func (c *Connection) gatherStatus() *ConnectionInfo {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	// services
 	services := make(map[string][]uint16)
 	for host, ports := range c.services {
-		for port, ok := range ports {
-			if ok {
-				services[host] = append(services[host], port)
-			}
+		for port := range ports {
+			services[host] = append(services[host], port)
 		}
 	}
 
-	tunnels := make([]interface{}, 0, len(c.tunnels))
+	tunnels := make([]*TunnelInfo, 0, len(c.tunnels))
 	for _, tunnel := range c.tunnels {
 		tunnels = append(tunnels, tunnel.gatherStatus())
 	}
 
-	sessions := make([]interface{}, 0, len(c.sessions))
+	sessions := make([]*SessionInfo, 0, len(c.sessions))
 	for _, session := range c.sessions {
 		sessions = append(sessions, session.gatherStatus())
 	}
 
-	return map[string]interface{}{
-		"id":              c.id,
-		"user":            c.user,
-		"admin":           c.admin,
-		"address":         c.remoteAddr.String(),
-		"location":        c.location,
-		"sessions":        sessions,
-		"sessions_closed": c.sessionsClosed,
-		"tunnels":         tunnels,
-		"tunnels_closed":  c.tunnelsClosed,
-		"created":         c.usage.created.Unix(),
-		"used":            c.usage.used.Unix(),
-		"up_time":         uint64(time.Since(c.usage.created).Seconds()),
-		"idle_time":       uint64(time.Since(c.usage.used).Seconds()),
-		"bytes_read":      c.usage.bytesRead,
-		"bytes_written":   c.usage.bytesWritten,
-		"services":        services,
-		"status":          c.status,
+	return &ConnectionInfo{
+		ID:             c.id,
+		User:           c.user,
+		Admin:          c.admin,
+		Address:        c.remoteAddr.String(),
+		Location:       c.location,
+		Sessions:       sessions,
+		SessionsClosed: c.sessionsClosed,
+		Tunnels:        tunnels,
+		TunnelsClosed:  c.tunnelsClosed,
+		Created:        c.usage.created.Unix(),
+		Used:           c.usage.used.Unix(),
+		UpTime:         uint64(time.Since(c.usage.created).Seconds()),
+		IdleTime:       uint64(time.Since(c.usage.used).Seconds()),
+		BytesRead:      atomic.LoadUint64(&c.usage.bytesRead),
+		BytesWritten:   atomic.LoadUint64(&c.usage.bytesWritten),
+		Services:       services,
+		Status:         c.status,
+
+		Fingerprint:        c.fingerprint(),
+		Certificate:        c.certificateInfo(),
+		CertificateExpires: c.certificateExpires(),
+		Warnings:           c.warnings(),
 	}
 }
 
-func (c *Connection) lookupService(host string, port uint16) bool {
+// sha256 fingerprint of the key the user logged in with, the certified key for certificates
+func (c *Connection) fingerprint() string {
+	if c.certificate != nil {
+		return ssh.FingerprintSHA256(c.certificate.Key)
+	}
+	if c.publicKey != nil {
+		return ssh.FingerprintSHA256(c.publicKey)
+	}
+	return ""
+}
+
+func (c *Connection) certificateInfo() *CertificateInfo {
+	if c.certificate == nil {
+		return nil
+	}
+	return newCertificateInfo(c.certificate)
+}
+
+// when the certificate the user logged in with expires, zero when never or without a certificate
+func (c *Connection) certificateExpires() int64 {
+	if c.certificate == nil || c.certificate.ValidBefore == ssh.CertTimeInfinity {
+		return 0
+	}
+	return int64(c.certificate.ValidBefore)
+}
+
+// problems with the connection that need attention
+func (c *Connection) warnings() []string {
+	var warnings []string
+	if c.certificate != nil && c.gateway.expiresSoon(c.certificate) {
+		warnings = append(warnings, fmt.Sprintf("certificate expires at %s", time.Unix(c.certificateExpires(), 0).Format(time.RFC3339)))
+	}
+	return warnings
+}
+
+// returns the services this connection advertises with their tunnel statistics
+func (c *Connection) gatherServices() []*ServiceInfo {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if _, ok := c.services[host]; !ok {
-		return false
+	// count active tunnels opened towards each service
+	tunnelsCount := make(map[string]int)
+	for _, tunnel := range c.tunnels {
+		if tunnel.channelType != "forwarded-tcpip" {
+			continue
+		}
+		if data, err := unmarshalTunnelData(tunnel.extraData); err == nil {
+			tunnelsCount[data.Host]++
+		}
 	}
 
-	return c.services[host][port]
+	services := make([]*ServiceInfo, 0, len(c.services))
+	for host, ports := range c.services {
+		var registered time.Time
+		list := make([]uint16, 0, len(ports))
+		for port, created := range ports {
+			list = append(list, port)
+			if registered.IsZero() || created.Before(registered) {
+				registered = created
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+
+		services = append(services, &ServiceInfo{
+			Name:         host + "." + c.user,
+			Host:         host,
+			User:         c.user,
+			Ports:        list,
+			Connection:   c.id,
+			Address:      c.remoteAddr.String(),
+			Registered:   registered.Unix(),
+			UpTime:       uint64(time.Since(registered).Seconds()),
+			TunnelsCount: tunnelsCount[host],
+		})
+	}
+	return services
+}
+
+// whether this connection may open tunnels to services of the target connection
+func (c *Connection) permitTunnel(target *Connection) bool {
+	return c.admin
+}
+
+func (c *Connection) lookupService(host string, port uint16) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.services[host][port]
+	return ok
 }
 
 func (c *Connection) registerService(host string, port uint16) error {
@@ -239,14 +388,18 @@ func (c *Connection) registerService(host string, port uint16) error {
 	defer c.lock.Unlock()
 
 	if _, ok := c.services[host]; !ok {
-		c.services[host] = make(map[uint16]bool)
+		c.services[host] = make(map[uint16]time.Time)
 	}
-	if c.services[host][port] {
+	if _, ok := c.services[host][port]; ok {
 		return ErrServiceAlreadyRegistered
 	}
-	c.services[host][port] = true
+	c.services[host][port] = time.Now()
 
 	log.Debugf("registered service: user = %s, host = %s, port = %d", c.user, host, port)
+	c.gateway.events.publish(newConnectionEvent(EventServiceRegistered, c, map[string]interface{}{
+		"host": host,
+		"port": port,
+	}))
 	return nil
 }
 
@@ -256,9 +409,16 @@ func (c *Connection) deregisterService(host string, port uint16) error {
 
 	if _, ok := c.services[host]; ok {
 		delete(c.services[host], port)
+		if len(c.services[host]) == 0 {
+			delete(c.services, host)
+		}
 	}
 
 	log.Debugf("deregistered service: user = %s, host = %s, port = %d", c.user, host, port)
+	c.gateway.events.publish(newConnectionEvent(EventServiceDeregistered, c, map[string]interface{}{
+		"host": host,
+		"port": port,
+	}))
 	return nil
 }
 
@@ -282,8 +442,14 @@ func (c *Connection) handleRequest(request *ssh.Request) {
 	log.Debugf("request received: type = %s, want_reply = %v, payload = %v", request.Type, request.WantReply, request.Payload)
 
 	ok := false
+	var reply []byte
 	switch request.Type {
 	case "tcpip-forward":
+		if c.enrolling {
+			log.Warningf("enrolling connection is not allowed to forward ports: remote = %v", c.remoteAddr)
+			break
+		}
+
 		request, err := unmarshalForwardRequest(request.Payload)
 		if err != nil {
 			log.Warningf("failed to decode request: %s", err)
@@ -316,10 +482,20 @@ func (c *Connection) handleRequest(request *ssh.Request) {
 
 		ok = true
 
+	case requestHostKeysProve:
+		signatures, err := c.proveHostKeys(request.Payload)
+		if err != nil {
+			log.Warningf("failed to prove host keys: %s", err)
+			break
+		}
+
+		reply = signatures
+		ok = true
+
 	}
 
 	if request.WantReply {
-		if err := request.Reply(ok, nil); err != nil {
+		if err := request.Reply(ok, reply); err != nil {
 			log.Warningf("failed to reply to request: %s", err)
 		}
 	}
@@ -336,6 +512,14 @@ func (c *Connection) handleChannel(newChannel ssh.NewChannel) {
 	case "session":
 		ok, rejection, message = c.handleSessionChannel(newChannel)
 	case "direct-tcpip":
+		if c.enrolling {
+			rejection, message = ssh.Prohibited, "permission denied"
+			break
+		}
+		if c.gateway.isDraining() {
+			rejection, message = ssh.ResourceShortage, "gateway is shutting down"
+			break
+		}
 		ok, rejection, message = c.handleTunnelChannel(newChannel)
 	}
 
@@ -397,18 +581,21 @@ func (c *Connection) handleTunnelChannel(newChannel ssh.NewChannel) (bool, ssh.R
 
 	data, err := unmarshalTunnelData(newChannel.ExtraData())
 	if err != nil {
+		c.gateway.metrics.tunnelFailed("invalid_request")
 		return false, ssh.UnknownChannelType, "failed to decode extra data"
 	}
 
 	// look up connection by name
 	connection, host, port := c.gateway.lookupConnectionService(data.Host, uint16(data.Port))
 	if connection == nil {
+		c.gateway.metrics.tunnelFailed("service_not_found")
 		return false, ssh.ConnectionFailed, "service not found or not online"
 	}
 
 	// see if this connection is allowed
-	if !c.admin {
+	if !c.permitTunnel(connection) {
 		log.Warningf("no permission to port forward: user = %s", c.user)
+		c.gateway.metrics.tunnelFailed("permission_denied")
 		return false, ssh.Prohibited, "permission denied"
 	}
 
@@ -420,18 +607,19 @@ func (c *Connection) handleTunnelChannel(newChannel ssh.NewChannel) (bool, ssh.R
 		OriginPort:    data.OriginPort,
 	}
 
-	tunnel2, err := connection.openTunnel("forwarded-tcpip", marshalTunnelData(data2), map[string]interface{}{
-		"origin": data.OriginAddress,
-		"from": map[string]interface{}{
-			"address": c.remoteAddr.String(),
-			"user":    c.user,
+	tunnel2, err := connection.openTunnel("forwarded-tcpip", marshalTunnelData(data2), &tunnelMetadata{
+		origin: data.OriginAddress,
+		service: &TunnelService{
+			Host: data.Host,
+			Port: data.Port,
 		},
-		"service": map[string]interface{}{
-			"host": data.Host,
-			"port": data.Port,
+		from: &TunnelEndpoint{
+			User:    c.user,
+			Address: c.remoteAddr.String(),
 		},
 	})
 	if err != nil {
+		c.gateway.metrics.tunnelFailed("connect_failed")
 		return false, ssh.ConnectionFailed, "failed to connect"
 	}
 	defer func() {
@@ -457,15 +645,15 @@ func (c *Connection) handleTunnelChannel(newChannel ssh.NewChannel) (bool, ssh.R
 		}
 	}()
 
-	tunnel := newTunnel(c, channel, newChannel.ChannelType(), newChannel.ExtraData(), map[string]interface{}{
-		"origin": data.OriginAddress,
-		"to": map[string]interface{}{
-			"user":    connection.user,
-			"address": connection.remoteAddr.String(),
+	tunnel := newTunnel(c, channel, newChannel.ChannelType(), newChannel.ExtraData(), &tunnelMetadata{
+		origin: data.OriginAddress,
+		service: &TunnelService{
+			Host: data.Host,
+			Port: data.Port,
 		},
-		"service": map[string]interface{}{
-			"host": data.Host,
-			"port": data.Port,
+		to: &TunnelEndpoint{
+			User:    connection.user,
+			Address: connection.remoteAddr.String(),
 		},
 	})
 	c.addTunnel(tunnel)
@@ -481,7 +669,7 @@ func (c *Connection) handleTunnelChannel(newChannel ssh.NewChannel) (bool, ssh.R
 }
 
 // open a channel from the server to the client side
-func (c *Connection) openTunnel(channelType string, extraData []byte, metadata map[string]interface{}) (*Tunnel, error) {
+func (c *Connection) openTunnel(channelType string, extraData []byte, metadata *tunnelMetadata) (*Tunnel, error) {
 	log.Debugf("opening channel: type = %s, data = %v", channelType, extraData)
 
 	channel, requests, err := c.conn.OpenChannel(channelType, extraData)
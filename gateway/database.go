@@ -1,16 +1,31 @@
 package gateway
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 var (
-	bucketUsers = []byte("users")
-	buckets     = [][]byte{
+	ErrKeyAlreadyExists = errors.New("gatewaysshd: key already exists")
+	ErrInvalidToken     = errors.New("gatewaysshd: invalid or expired token")
+)
+
+var (
+	bucketUsers        = []byte("users")
+	bucketKeys         = []byte("keys")
+	bucketEnrollments  = []byte("enrollments")
+	bucketCertificates = []byte("certificates")
+	bucketBans         = []byte("bans")
+	buckets            = [][]byte{
 		bucketUsers,
+		bucketKeys,
+		bucketEnrollments,
+		bucketCertificates,
+		bucketBans,
 	}
 )
 
@@ -53,8 +68,8 @@ type userModel struct {
 	ID string `json:"id"`
 
 	// ip address and geo location
-	Address  string                 `json:"address"`
-	Location map[string]interface{} `json:"location"`
+	Address  string    `json:"address"`
+	Location *Location `json:"location"`
 
 	// reported status
 	Status json.RawMessage `json:"status"`
@@ -143,3 +158,289 @@ func (d *Database) getUser(id string) (*userModel, error) {
 	}
 	return result, nil
 }
+
+// a public key a user may log in with, stored in a bucket per user by fingerprint
+type keyModel struct {
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint"`
+
+	// in authorized keys format
+	PublicKey string `json:"public_key"`
+
+	Label string `json:"label,omitempty"`
+	Admin bool   `json:"admin,omitempty"`
+
+	// timestamps, zero expires means never
+	Created  int64 `json:"created"`
+	Expires  int64 `json:"expires,omitempty"`
+	LastUsed int64 `json:"last_used,omitempty"`
+}
+
+func (d *Database) addKey(key *keyModel) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return putKey(tx, key)
+	})
+}
+
+func putKey(tx *bolt.Tx, key *keyModel) error {
+	bucket, err := tx.Bucket(bucketKeys).CreateBucketIfNotExists([]byte(key.User))
+	if err != nil {
+		return err
+	}
+	if bucket.Get([]byte(key.Fingerprint)) != nil {
+		return ErrKeyAlreadyExists
+	}
+
+	raw, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key.Fingerprint), raw)
+}
+
+func (d *Database) getKey(user, fingerprint string) (*keyModel, error) {
+	var result *keyModel
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketKeys).Bucket([]byte(user))
+		if bucket == nil {
+			return nil
+		}
+		if raw := bucket.Get([]byte(fingerprint)); raw != nil {
+			return json.Unmarshal(raw, &result)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// list keys of a user, or of all users when user is empty
+func (d *Database) listKeys(user string) ([]*keyModel, error) {
+	var results []*keyModel
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeys).ForEach(func(name, _ []byte) error {
+			if user != "" && string(name) != user {
+				return nil
+			}
+			return tx.Bucket(bucketKeys).Bucket(name).ForEach(func(_, raw []byte) error {
+				var model *keyModel
+				if err := json.Unmarshal(raw, &model); err != nil {
+					return err
+				}
+				results = append(results, model)
+				return nil
+			})
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// delete a key, returns false when there is no such key
+func (d *Database) deleteKey(user, fingerprint string) (bool, error) {
+	deleted := false
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketKeys).Bucket([]byte(user))
+		if bucket == nil || bucket.Get([]byte(fingerprint)) == nil {
+			return nil
+		}
+		deleted = true
+		return bucket.Delete([]byte(fingerprint))
+	}); err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+func (d *Database) touchKey(user, fingerprint string, used int64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketKeys).Bucket([]byte(user))
+		if bucket == nil {
+			return nil
+		}
+		raw := bucket.Get([]byte(fingerprint))
+		if raw == nil {
+			return nil
+		}
+
+		var model *keyModel
+		if err := json.Unmarshal(raw, &model); err != nil {
+			return err
+		}
+		model.LastUsed = used
+
+		raw, err := json.Marshal(model)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fingerprint), raw)
+	})
+}
+
+// a pending enrollment, stored by the hash of its one-time token
+type enrollmentModel struct {
+	User  string `json:"user"`
+	Label string `json:"label,omitempty"`
+	Admin bool   `json:"admin,omitempty"`
+
+	// when the token expires, and when the enrolled key expires, zero means never
+	Expires    int64 `json:"expires"`
+	KeyExpires int64 `json:"key_expires,omitempty"`
+
+	// issue a certificate for the user as principal instead of storing the key,
+	// valid for the given number of seconds, zero uses the default
+	Certificate bool  `json:"certificate,omitempty"`
+	Validity    int64 `json:"validity,omitempty"`
+
+	Created int64 `json:"created"`
+}
+
+func (d *Database) addEnrollment(hash string, enrollment *enrollmentModel) error {
+	raw, err := json.Marshal(enrollment)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketEnrollments).Put([]byte(hash), raw)
+	})
+}
+
+// consume an enrollment token, which only happens when redeem succeeds within the same transaction
+func (d *Database) redeemEnrollment(hash string, redeem func(*bolt.Tx, *enrollmentModel) error) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(bucketEnrollments).Get([]byte(hash))
+		if raw == nil {
+			return ErrInvalidToken
+		}
+		var enrollment *enrollmentModel
+		if err := json.Unmarshal(raw, &enrollment); err != nil {
+			return err
+		}
+		if time.Now().Unix() > enrollment.Expires {
+			return ErrInvalidToken
+		}
+		if err := tx.Bucket(bucketEnrollments).Delete([]byte(hash)); err != nil {
+			return err
+		}
+		return redeem(tx, enrollment)
+	})
+}
+
+// an audit record of a certificate issued by the gateway, stored by serial
+type certificateModel struct {
+	Serial      uint64            `json:"serial"`
+	KeyID       string            `json:"key_id"`
+	Principals  []string          `json:"principals"`
+	Fingerprint string            `json:"fingerprint"`
+	Extensions  map[string]string `json:"extensions"`
+	ValidAfter  int64             `json:"valid_after"`
+	ValidBefore int64             `json:"valid_before"`
+
+	// the signed certificate in authorized keys format
+	Certificate string `json:"certificate"`
+
+	// when, why and for whom the certificate was issued
+	Issued  int64  `json:"issued"`
+	Reason  string `json:"reason"`
+	Address string `json:"address"`
+}
+
+// allocate the next serial and record the certificate signed with it
+func recordCertificate(tx *bolt.Tx, sign func(serial uint64) (*certificateModel, error)) error {
+	bucket := tx.Bucket(bucketCertificates)
+	serial, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	model, err := sign(serial)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, serial)
+	return bucket.Put(key, raw)
+}
+
+func (d *Database) recordCertificate(sign func(serial uint64) (*certificateModel, error)) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return recordCertificate(tx, sign)
+	})
+}
+
+// list issued certificates in order of serial, optionally only those with the principal
+func (d *Database) listCertificates(principal string) ([]*certificateModel, error) {
+	var results []*certificateModel
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCertificates).ForEach(func(_, raw []byte) error {
+			var model *certificateModel
+			if err := json.Unmarshal(raw, &model); err != nil {
+				return err
+			}
+			if principal != "" {
+				found := false
+				for _, p := range model.Principals {
+					if p == principal {
+						found = true
+					}
+				}
+				if !found {
+					return nil
+				}
+			}
+			results = append(results, model)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// a temporary ban of an ip address or prefix, stored by address
+type banModel struct {
+	Address  string `json:"address"`
+	Failures int    `json:"failures"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires"`
+}
+
+func (d *Database) putBan(ban *banModel) error {
+	raw, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Put([]byte(ban.Address), raw)
+	})
+}
+
+func (d *Database) deleteBan(address string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Delete([]byte(address))
+	})
+}
+
+func (d *Database) listBans() ([]*banModel, error) {
+	var results []*banModel
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).ForEach(func(_, raw []byte) error {
+			var model *banModel
+			if err := json.Unmarshal(raw, &model); err != nil {
+				return err
+			}
+			results = append(results, model)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
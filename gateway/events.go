@@ -0,0 +1,176 @@
+package gateway
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// types of events published by the gateway
+const (
+	EventConnectionOpened    = "connection.opened"
+	EventConnectionClosed    = "connection.closed"
+	EventServiceRegistered   = "service.registered"
+	EventServiceDeregistered = "service.deregistered"
+	EventTunnelOpened        = "tunnel.opened"
+	EventTunnelClosed        = "tunnel.closed"
+	EventAuthFailed          = "auth.failed"
+	EventStatusReported      = "status.reported"
+	EventAddressBanned       = "address.banned"
+
+	// sent to a subscriber after it fell behind and missed events
+	EventDropped = "events.dropped"
+)
+
+// number of events buffered for each subscriber before events are dropped
+const eventBufferSize = 256
+
+// something that happened in the gateway
+type Event struct {
+	Type       string      `json:"type"`
+	Timestamp  int64       `json:"timestamp"`
+	User       string      `json:"user,omitempty"`
+	Address    string      `json:"address,omitempty"`
+	Connection string      `json:"connection,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+func newDroppedEvent(count uint64) *Event {
+	return &Event{
+		Type:      EventDropped,
+		Timestamp: time.Now().Unix(),
+		Data: map[string]interface{}{
+			"count": count,
+		},
+	}
+}
+
+func newConnectionEvent(eventType string, c *Connection, data interface{}) *Event {
+	return &Event{
+		Type:       eventType,
+		Timestamp:  time.Now().Unix(),
+		User:       c.user,
+		Address:    c.remoteAddr.String(),
+		Connection: c.id,
+		Data:       data,
+	}
+}
+
+// selects events by glob patterns on event type and user, empty matches all
+type EventFilter struct {
+	Types []string
+	Users []string
+}
+
+// creates a filter, validating the patterns
+func NewEventFilter(types, users []string) (*EventFilter, error) {
+	for _, pattern := range append(append([]string{}, types...), users...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &EventFilter{
+		Types: types,
+		Users: users,
+	}, nil
+}
+
+func (f *EventFilter) Match(event *Event) bool {
+	if f == nil {
+		return true
+	}
+	return matchAny(f.Types, event.Type) && matchAny(f.Users, event.User)
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// a subscriber of gateway events, events are dropped when it falls behind
+type Subscription struct {
+	bus       *eventBus
+	filter    *EventFilter
+	events    chan *Event
+	dropped   uint64
+	closeOnce sync.Once
+}
+
+// the channel of events, closed when the subscription is closed
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// returns and resets the number of events dropped since last call
+func (s *Subscription) TakeDropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// stop receiving events
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.bus.unsubscribe(s)
+		close(s.events)
+	})
+}
+
+// fans out events to subscribers without ever blocking the publisher
+type eventBus struct {
+	subscriptions map[*Subscription]struct{}
+	lock          *sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscriptions: make(map[*Subscription]struct{}),
+		lock:          &sync.Mutex{},
+	}
+}
+
+func (b *eventBus) subscribe(filter *EventFilter) *Subscription {
+	return b.subscribeWithBuffer(filter, eventBufferSize)
+}
+
+func (b *eventBus) subscribeWithBuffer(filter *EventFilter, size int) *Subscription {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	subscription := &Subscription{
+		bus:    b,
+		filter: filter,
+		events: make(chan *Event, size),
+	}
+	b.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+func (b *eventBus) unsubscribe(s *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.subscriptions, s)
+}
+
+func (b *eventBus) publish(event *Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for subscription := range b.subscriptions {
+		if !subscription.filter.Match(event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
@@ -1,15 +1,15 @@
 package gateway
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/op/go-logging"
@@ -22,159 +22,298 @@ var (
 	ErrInvalidCertificate = errors.New("gatewaysshd: invalid certificate")
 )
 
+// settings that tune the behavior of a gateway
+type Settings struct {
+	// accept unknown commands that are valid json as legacy status reports
+	AllowLegacyStatus bool
+
+	// outbound webhooks notified of lifecycle events
+	Webhooks []*WebhookSettings
+
+	// label traffic and connection metrics by user, beware of cardinality
+	MetricsPerUser bool
+
+	// decides who may log in, defaults to certificates signed by the certificate
+	// authorities and public keys in the database
+	Authenticator Authenticator
+
+	// asked in turn after the default authenticators reject a key, unused when
+	// the authenticator is replaced
+	Authenticators []Authenticator
+
+	// what certificates signed by each certificate authority may do, defaults to only
+	// the first certificate authority passing down permissions
+	CertificatePolicy *CertificatePolicy
+
+	// accept logins as the enroll user with any key, which can only enroll that key
+	// with a one-time token
+	Enrollment bool
+
+	// signs certificates for devices enrolling with one-time tokens, the public key
+	// must be one of the certificate authorities
+	SigningKey ssh.Signer
+
+	// how long issued certificates are valid, defaults to 7 days
+	CertificateValidity time.Duration
+
+	// extensions of issued certificates, defaults to permit-pty, admins are also
+	// given permit-port-forwarding
+	CertificateExtensions map[string]string
+
+	// called by the admin reload command to re-read keys and certificates, usually
+	// by calling Reload, the command is disabled when nil
+	ReloadFunc func() error
+
+	// how long before expiry certificates can be renewed with the renew command,
+	// connections are warned about certificates expiring within it, defaults to 72 hours
+	RenewalWindow time.Duration
+
+	// which addresses may connect, optionally depending on the user, nil allows all
+	AccessPolicy *AccessPolicy
+
+	// path to a geoip asn or isp database to look up autonomous systems of addresses,
+	// which are also added to the locations of connections and users
+	ASNDatabase string
+
+	// path to a geoip connection type database, such as cable/dsl or cellular, added
+	// to the locations of connections and users
+	ConnectionTypeDatabase string
+
+	// temporarily ban addresses that fail to authenticate too often, disabled when nil
+	Bans *BanSettings
+}
+
 // an instance of gateway, contains runtime states
 type Gateway struct {
-	geoipDatabase    string
+	serverVersion    string
+	geoip            *geoipDatabase
+	asn              *geoipDatabase
+	connectionType   *geoipDatabase
+	revocationList   string
 	database         *Database
+	certificates     *CertificateAuthenticator
+	authenticator    Authenticator
+	authority        *certificateAuthority
+	settings         *Settings
+	events           *eventBus
+	metrics          *metrics
+	webhooks         []*webhook
 	config           *ssh.ServerConfig
+	hostKeys         *hostKeys
+	access           *AccessPolicy
+	bans             *banTracker
 	connectionsIndex map[string][]*Connection
 	connectionsList  []*Connection
 	lock             *sync.Mutex
+	configLock       sync.Mutex
+	revocationLock   sync.Mutex
 	closeOnce        sync.Once
+	draining         int32
 }
 
 // creates a new instance of gateway
-func NewGateway(serverVersion string, caPublicKeys, hostCertificate, hostPrivateKey []byte, revocationList string, geoipDatabase string, database *Database) (*Gateway, error) {
+func NewGateway(serverVersion string, caPublicKeys, hostCertificate, hostPrivateKey []byte, revocationList string, geoipDatabase string, database *Database, settings *Settings) (*Gateway, error) {
+	if settings == nil {
+		settings = &Settings{}
+	}
 
-	// parse certificate authority
-	var cas []ssh.PublicKey
-	for len(caPublicKeys) > 0 {
-		ca, _, _, rest, err := ssh.ParseAuthorizedKey(caPublicKeys)
-		if err != nil {
+	// the certificate authenticator also checks the host certificate for revocation
+	certificates, err := NewCertificateAuthenticator(caPublicKeys, revocationList)
+	if err != nil {
+		return nil, err
+	}
+	certificates.SetPolicy(settings.CertificatePolicy)
+	authenticator := settings.Authenticator
+	if authenticator == nil {
+		authenticators := MultiAuthenticator{certificates}
+		if database != nil {
+			authenticators = append(authenticators, NewDatabaseAuthenticator(database))
+		}
+		authenticator = append(authenticators, settings.Authenticators...)
+	}
+
+	// certificates signed by the gateway must be accepted by the gateway
+	var authority *certificateAuthority
+	if settings.SigningKey != nil {
+		if err := checkSigningKey(certificates, settings.SigningKey); err != nil {
 			return nil, err
 		}
-		log.Debugf("auth: ca_public_key = %v", ca)
-		cas = append(cas, ca)
-		caPublicKeys = rest
+		authority = newCertificateAuthority(settings.SigningKey, settings.CertificateValidity, settings.CertificateExtensions)
 	}
 
-	// parse host certificate
-	parsed, _, _, _, err := ssh.ParseAuthorizedKey(hostCertificate)
+	hostKeys, err := loadHostKeys(hostCertificate, hostPrivateKey, certificates)
 	if err != nil {
 		return nil, err
 	}
-	cert, ok := parsed.(*ssh.Certificate)
-	if !ok {
-		return nil, ErrInvalidCertificate
+
+	var bans *banTracker
+	if settings.Bans != nil {
+		bans, err = newBanTracker(settings.Bans, database)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	principal := "localhost"
-	if len(cert.ValidPrincipals) > 0 {
-		principal = cert.ValidPrincipals[0]
+	// start delivering events to webhooks
+	events := newEventBus()
+	var webhooks []*webhook
+	for _, settings := range settings.Webhooks {
+		webhook, err := newWebhook(settings, events)
+		if err != nil {
+			for _, webhook := range webhooks {
+				webhook.Close(webhookFlushTimeout)
+			}
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
 	}
 
-	// parse host key
-	key, err := ssh.ParsePrivateKey(hostPrivateKey)
-	if err != nil {
-		return nil, err
+	g := &Gateway{
+		serverVersion:    serverVersion,
+		geoip:            newGeoipDatabase(geoipDatabase),
+		revocationList:   revocationList,
+		database:         database,
+		certificates:     certificates,
+		authenticator:    authenticator,
+		authority:        authority,
+		settings:         settings,
+		events:           events,
+		metrics:          newMetrics(settings.MetricsPerUser),
+		webhooks:         webhooks,
+		bans:             bans,
+		access:           settings.AccessPolicy,
+		connectionsIndex: make(map[string][]*Connection),
+		connectionsList:  make([]*Connection, 0),
+		lock:             &sync.Mutex{},
+	}
+	if settings.ASNDatabase != "" {
+		g.asn = newGeoipDatabase(settings.ASNDatabase)
+	}
+	if settings.ConnectionTypeDatabase != "" {
+		g.connectionType = newGeoipDatabase(settings.ConnectionTypeDatabase)
 	}
+	g.config = g.newServerConfig(hostKeys)
+	g.hostKeys = hostKeys
+	return g, nil
+}
 
-	// create signer for host
-	host, err := ssh.NewCertSigner(cert, key)
+// re-read the certificate authorities, host certificate and host private key for new
+// connections, existing connections are not affected, nothing changes when any is invalid
+func (g *Gateway) Reload(caPublicKeys, hostCertificate, hostPrivateKey []byte) error {
+	certificates, err := NewCertificateAuthenticator(caPublicKeys, g.revocationList)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if g.authority != nil {
+		if err := checkSigningKey(certificates, g.authority.signer); err != nil {
+			return err
+		}
+	}
+	hostKeys, err := loadHostKeys(hostCertificate, hostPrivateKey, certificates)
+	if err != nil {
+		return err
 	}
-	log.Debugf("auth: host_public_key = %v", key.PublicKey())
 
-	// create checker
-	checker := &ssh.CertChecker{
-		IsUserAuthority: func(key ssh.PublicKey) bool {
-			for _, ca := range cas {
-				if bytes.Compare(ca.Marshal(), key.Marshal()) == 0 {
-					return true
-				}
-			}
-			log.Warningf("auth: unknown authority: %v", key)
-			return false
-		},
-		IsRevoked: func(cert *ssh.Certificate) bool {
-			// if revocation list file does not exist, assume everything is good
-			if _, err := os.Stat(revocationList); os.IsNotExist(err) {
-				return false
-			}
+	// the authorities are swapped in place, since the authenticator may be shared
+	g.certificates.setAuthorities(certificates.Authorities())
+	config := g.newServerConfig(hostKeys)
 
-			file, err := os.Open(revocationList)
-			if err != nil {
-				log.Errorf("auth: failed to open revocation list: %s", err)
-				return true
-			}
-			defer file.Close()
+	g.configLock.Lock()
+	defer g.configLock.Unlock()
 
-			// if line matches any of the following, it is considered revoked
-			matches := []string{
-				fmt.Sprintf("%s\n", cert.KeyId),
-				fmt.Sprintf("%d\n", cert.Serial),
-				fmt.Sprintf("%s/%d\n", cert.KeyId, cert.Serial),
-			}
+	g.config = config
+	g.hostKeys = hostKeys
+	log.Noticef("reloaded: authorities = %d, host_keys = %d", len(certificates.Authorities()), len(hostKeys.keys))
+	return nil
+}
 
-			reader := bufio.NewReader(file)
-			for {
-				line, err := reader.ReadString('\n')
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					log.Errorf("auth: failed to read revocation list: %s", err)
-					return true
-				}
-				if line[0] == '#' || line == "\n" {
-					continue
-				}
-				for _, match := range matches {
-					if line == match {
-						log.Warningf("auth: certificate revoked by revocation list: %s/%d", cert.KeyId, cert.Serial)
-						return true
-					}
-				}
-			}
-			return false
-		},
+// replace the certificate policy for new connections, nil restores the default
+// where only the first certificate authority passes down permissions
+func (g *Gateway) SetCertificatePolicy(policy *CertificatePolicy) {
+	g.certificates.SetPolicy(policy)
+}
+
+// the server config for new connections
+func (g *Gateway) serverConfig() *ssh.ServerConfig {
+	g.configLock.Lock()
+	defer g.configLock.Unlock()
+
+	return g.config
+}
+
+// the host keys for new connections
+func (g *Gateway) currentHostKeys() *hostKeys {
+	g.configLock.Lock()
+	defer g.configLock.Unlock()
+
+	return g.hostKeys
+}
+
+func (g *Gateway) newServerConfig(hostKeys *hostKeys) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: g.authenticate,
+		AuthLogCallback:   g.logAuthentication,
+		ServerVersion:     g.serverVersion,
 	}
 
-	// test the checker
-	log.Debugf("auth: testing host certificate using principal: %s", principal)
-	if err := checker.CheckCert(principal, cert); err != nil {
-		return nil, err
+	// a later host key replaces an earlier one of the same type, so add them in reverse
+	// to present the first of each type during handshakes, the plain keys are offered
+	// to clients that pinned a host key instead of trusting the certificate authority
+	for i := len(hostKeys.certificates) - 1; i >= 0; i-- {
+		config.AddHostKey(hostKeys.certificates[i])
 	}
+	for i := len(hostKeys.keys) - 1; i >= 0; i-- {
+		config.AddHostKey(hostKeys.keys[i])
+	}
+	return config
+}
 
-	// create server config
-	config := &ssh.ServerConfig{
-		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			permissions, err := checker.Authenticate(meta, key)
-			log.Debugf("auth: remote = %s, local = %s, public_key = %v, permissions = %v, err = %v", meta.RemoteAddr(), meta.LocalAddr(), key, permissions, err)
-			if err != nil {
-				return nil, err
-			}
+func (g *Gateway) authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	// any key may log in to enroll itself
+	if g.settings.Enrollment && meta.User() == enrollUser {
+		permissions := sanitizePermissions(&ssh.Permissions{}, key)
+		permissions.Extensions[extensionEnroll] = ""
+		return permissions, nil
+	}
 
-			// only the first ca is allowed to pass down permissions
-			cert, ok := key.(*ssh.Certificate)
-			if ok {
-				for _, ca := range cas {
-					if bytes.Compare(ca.Marshal(), cert.SignatureKey.Marshal()) == 0 {
-						return permissions, nil
-					}
-					break
-				}
-			}
+	permissions, err := g.authenticator.Authenticate(meta, key)
+	log.Debugf("auth: remote = %s, local = %v, public_key = %v, permissions = %v, err = %v", meta.RemoteAddr(), meta.LocalAddr(), key, permissions, err)
+	if err != nil {
+		return nil, err
+	}
+	if permissions == nil {
+		permissions = &ssh.Permissions{}
+	}
+	return sanitizePermissions(permissions, key), nil
+}
 
-			// return empty permission
-			return &ssh.Permissions{}, nil
-		},
-		AuthLogCallback: func(meta ssh.ConnMetadata, method string, err error) {
-			log.Debugf("auth: remote = %s, local = %s, method = %s, error = %v", meta.RemoteAddr(), meta.LocalAddr(), method, err)
-		},
-		ServerVersion: serverVersion,
+func (g *Gateway) logAuthentication(meta ssh.ConnMetadata, method string, err error) {
+	log.Debugf("auth: remote = %s, local = %v, method = %s, error = %v", meta.RemoteAddr(), meta.LocalAddr(), method, err)
+	if err != nil && method != "none" {
+		g.metrics.authFailed(err)
+		g.events.publish(&Event{
+			Type:      EventAuthFailed,
+			Timestamp: time.Now().Unix(),
+			User:      meta.User(),
+			Address:   meta.RemoteAddr().String(),
+			Data: map[string]interface{}{
+				"method": method,
+				"error":  err.Error(),
+			},
+		})
 	}
-	config.AddHostKey(host)
+}
 
-	return &Gateway{
-		geoipDatabase:    geoipDatabase,
-		database:         database,
-		config:           config,
-		connectionsIndex: make(map[string][]*Connection),
-		connectionsList:  make([]*Connection, 0),
-		lock:             &sync.Mutex{},
-	}, nil
+// the signing key must be one of the authorities, and only the first one passes down permissions
+func checkSigningKey(certificates *CertificateAuthenticator, signer ssh.Signer) error {
+	authorities := certificates.Authorities()
+	if !certificates.isAuthority(signer.PublicKey()) {
+		return ErrUnknownSigningKey
+	}
+	if certificates.Policy() == nil && !bytes.Equal(authorities[0].Marshal(), signer.PublicKey().Marshal()) {
+		log.Warningf("auth: signing key is not the first certificate authority, issued certificates will not grant permissions")
+	}
+	return nil
 }
 
 // close the gateway instance
@@ -183,9 +322,95 @@ func (g *Gateway) Close() {
 		for _, connection := range g.Connections() {
 			connection.Close()
 		}
+
+		// deliver the events of closing the connections before stopping the webhooks
+		var wg sync.WaitGroup
+		for _, w := range g.webhooks {
+			wg.Add(1)
+			go func(w *webhook) {
+				defer wg.Done()
+				w.Close(webhookFlushTimeout)
+			}(w)
+		}
+		wg.Wait()
+
+		g.geoip.Close()
+		g.asn.Close()
+		g.connectionType.Close()
 	})
 }
 
+// how often a shutdown checks whether tunnels are still open
+const drainInterval = 250 * time.Millisecond
+
+// how long connections are given to close at the end of a shutdown, once their clients took the reason
+const closeTimeout = 1 * time.Second
+
+// shut down gracefully, new connections and tunnels are refused and clients are told that
+// the gateway is shutting down, then open tunnels are given up to the timeout to finish
+// before all connections are closed
+func (g *Gateway) Shutdown(timeout time.Duration) {
+	atomic.StoreInt32(&g.draining, 1)
+	deadline := time.Now().Add(timeout)
+
+	// a client that stopped reading blocks writes to it, so each one is notified on its own
+	connections := g.Connections()
+	log.Noticef("shutdown: draining %d connections, timeout = %s", len(connections), timeout)
+	for _, connection := range connections {
+		go connection.notifyShutdown(timeout)
+	}
+
+	for {
+		tunnels := 0
+		for _, connection := range g.Connections() {
+			tunnels += len(connection.Tunnels())
+		}
+		if tunnels == 0 {
+			log.Noticef("shutdown: all tunnels finished")
+			break
+		}
+		if !time.Now().Before(deadline) {
+			log.Warningf("shutdown: closing %d tunnels still open after %s", tunnels, timeout)
+			break
+		}
+		time.Sleep(drainInterval)
+	}
+
+	// connections are disconnected together, and those whose clients stopped reading
+	// are closed on the network first, so that writes to them fail instead of blocking
+	connections = g.Connections()
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+
+		var wg sync.WaitGroup
+		for _, connection := range connections {
+			wg.Add(1)
+			go func(connection *Connection) {
+				defer wg.Done()
+				connection.Disconnect("gateway is shutting down")
+			}(connection)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(disconnectTimeout + closeTimeout):
+		log.Warningf("shutdown: closing connections that did not close within %s", disconnectTimeout+closeTimeout)
+		for _, connection := range connections {
+			if err := connection.conn.Close(); err != nil {
+				log.Debugf("failed to close connection: %s", err)
+			}
+		}
+	}
+	g.Close()
+}
+
+// whether the gateway is shutting down
+func (g *Gateway) isDraining() bool {
+	return atomic.LoadInt32(&g.draining) != 0
+}
+
 // handle an incoming ssh connection
 func (g *Gateway) HandleConnection(c net.Conn) {
 	log.Infof("new tcp connection: remote = %s, local = %s", c.RemoteAddr(), c.LocalAddr())
@@ -197,12 +422,41 @@ func (g *Gateway) HandleConnection(c net.Conn) {
 		}
 	}()
 
+	if g.isDraining() {
+		log.Infof("rejecting connection while shutting down: remote = %s", c.RemoteAddr())
+		g.metrics.connectionRejected("shutdown")
+		return
+	}
+
+	// banned addresses are dropped before spending any effort on the handshake
+	if g.isBanned(c.RemoteAddr()) {
+		g.metrics.connectionRejected("banned")
+		return
+	}
+
+	// so are addresses denied by the access policy whoever logs in
+	var address *remoteAddress
+	if tcp, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		address = &remoteAddress{gateway: g, ip: tcp.IP}
+	}
+	if !g.checkAccess(address, "", false) {
+		return
+	}
+
 	usage := newUsage()
-	conn, channels, requests, err := ssh.NewServerConn(wrapConn(c, usage), g.config)
+	started := time.Now()
+	conn, channels, requests, err := ssh.NewServerConn(wrapConn(c, usage), g.serverConfig())
+	g.metrics.handshakeCompleted(time.Since(started))
 	if err != nil {
 		log.Warningf("failed during ssh handshake: %s", err)
+
+		// clients offer keys in turn, so only a handshake that fails as a whole counts
+		if isFailedLogin(err) {
+			g.authenticationFailed(c.RemoteAddr())
+		}
 		return
 	}
+	g.metrics.authSucceeded()
 	defer func() {
 		if conn != nil {
 			if err := conn.Close(); err != nil {
@@ -211,8 +465,15 @@ func (g *Gateway) HandleConnection(c net.Conn) {
 		}
 	}()
 
+	// rules for some principals are checked once the user is known
+	if !g.checkAccess(address, conn.User(), true) {
+		return
+	}
+	g.authenticationSucceeded(c.RemoteAddr(), conn.Permissions)
+
 	// look up connection
-	location := lookupLocation(g.geoipDatabase, c.RemoteAddr().(*net.TCPAddr).IP)
+	ip := c.RemoteAddr().(*net.TCPAddr).IP
+	location := lookupNetwork(g.asn, g.connectionType, ip, lookupLocation(g.geoip, ip))
 
 	// create a connection and handle it
 	connection := newConnection(g, conn, usage, location)
@@ -221,6 +482,7 @@ func (g *Gateway) HandleConnection(c net.Conn) {
 	// handle requests and channels on this connection
 	go connection.handleRequests(requests)
 	go connection.handleChannels(channels)
+	go connection.announceHostKeys()
 
 	// don't close connection on success
 	conn = nil
@@ -234,6 +496,13 @@ func (g *Gateway) addConnection(c *Connection) {
 
 	g.connectionsIndex[c.user] = append([]*Connection{c}, g.connectionsIndex[c.user]...)
 	g.connectionsList = append([]*Connection{c}, g.connectionsList...)
+
+	g.events.publish(newConnectionEvent(EventConnectionOpened, c, map[string]interface{}{
+		"admin":       c.admin,
+		"location":    c.location,
+		"fingerprint": c.fingerprint(),
+		"certificate": c.certificateInfo(),
+	}))
 }
 
 func (g *Gateway) deleteConnection(c *Connection) {
@@ -255,6 +524,13 @@ func (g *Gateway) deleteConnection(c *Connection) {
 		}
 	}
 	g.connectionsList = connections
+
+	g.metrics.connectionClosed(c.user, c.usage)
+	g.events.publish(newConnectionEvent(EventConnectionClosed, c, map[string]interface{}{
+		"up_time":       uint64(time.Since(c.usage.created).Seconds()),
+		"bytes_read":    atomic.LoadUint64(&c.usage.bytesRead),
+		"bytes_written": atomic.LoadUint64(&c.usage.bytesWritten),
+	}))
 }
 
 func (g *Gateway) lookupConnectionService(host string, port uint16) (*Connection, string, uint16) {
@@ -278,6 +554,71 @@ func (g *Gateway) lookupConnectionService(host string, port uint16) (*Connection
 	return nil, "", 0
 }
 
+// authenticate a public key or certificate for the user exactly like a ssh login would,
+// returns whether the user is an admin, used to authenticate requests outside of ssh
+func (g *Gateway) AuthenticatePublicKey(user string, remoteAddr net.Addr, key ssh.PublicKey) (bool, error) {
+	permissions, err := g.authenticate(&keyMetadata{
+		user:       user,
+		remoteAddr: remoteAddr,
+	}, key)
+	if err != nil {
+		return false, err
+	}
+	if isEnrolling(permissions) {
+		return false, ErrAccessDenied
+	}
+	return isAdmin(permissions), nil
+}
+
+// subscribe to events matching the filter, the subscription must be closed after use
+func (g *Gateway) Subscribe(filter *EventFilter) *Subscription {
+	return g.events.subscribe(filter)
+}
+
+// disconnect a connection by its id, returns false if not found
+func (g *Gateway) KillConnection(id, reason string) bool {
+	for _, connection := range g.Connections() {
+		if connection.id == id {
+			connection.Disconnect(reason)
+			return true
+		}
+	}
+	return false
+}
+
+// disconnect all connections of a user, returns the number of connections closed
+func (g *Gateway) KillUser(user, reason string) int {
+	g.lock.Lock()
+	connections := make([]*Connection, len(g.connectionsIndex[user]))
+	copy(connections, g.connectionsIndex[user])
+	g.lock.Unlock()
+
+	// connections are disconnected together, so that a stuck one does not hold up the rest
+	var wg sync.WaitGroup
+	for _, connection := range connections {
+		wg.Add(1)
+		go func(connection *Connection) {
+			defer wg.Done()
+			connection.Disconnect(reason)
+		}(connection)
+	}
+	wg.Wait()
+	return len(connections)
+}
+
+// close a tunnel by its id, returns false if not found
+func (g *Gateway) CloseTunnel(id, reason string) bool {
+	for _, connection := range g.Connections() {
+		for _, tunnel := range connection.Tunnels() {
+			if tunnel.id == id {
+				tunnel.Disconnect(reason)
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // returns a list of connections
 func (g *Gateway) Connections() []*Connection {
 	g.lock.Lock()
@@ -294,28 +635,52 @@ func (g *Gateway) ScavengeConnections(timeout time.Duration) {
 		idle := time.Since(connection.Used())
 		if idle > timeout {
 			log.Infof("scavenge: connection for %s timed out after %d seconds", connection.user, uint64(idle.Seconds()))
+			g.metrics.connectionScavenged()
 			connection.Close()
 		}
 	}
+	if g.bans != nil {
+		g.bans.expire()
+	}
 }
 
-func (g *Gateway) gatherStatus() map[string]interface{} {
-	g.lock.Lock()
-	defer g.lock.Unlock()
+// append an entry to the revocation list, takes effect on the next authentication
+func (g *Gateway) revoke(entry string) error {
+	g.revocationLock.Lock()
+	defer g.revocationLock.Unlock()
 
-	connections := make([]interface{}, 0, len(g.connectionsList))
-	for _, connection := range g.connectionsList {
-		connections = append(connections, connection.gatherStatus())
+	file, err := os.OpenFile(g.revocationList, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	return map[string]interface{}{
-		"connections": connections,
+	_, err = fmt.Fprintf(file, "%s\n", entry)
+	return err
+}
+
+// list known users, or only the given users
+func (g *Gateway) ListUsers(ids ...string) ([]*UserInfo, error) {
+	users, err := g.listUsers()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		filtered := make([]*UserInfo, 0, len(ids))
+		for _, user := range users {
+			for _, id := range ids {
+				if user.ID == id {
+					filtered = append(filtered, user)
+				}
+			}
+		}
+		users = filtered
 	}
+	return users, nil
 }
 
-func (g *Gateway) ListUsers() (interface{}, error) {
-	users := make(map[string]map[string]interface{})
-	connectionsCount := make(map[string]int)
+func (g *Gateway) listUsers() ([]*UserInfo, error) {
+	users := make(map[string]*UserInfo)
 
 	// first collect users from live connections
 	func() {
@@ -324,14 +689,14 @@ func (g *Gateway) ListUsers() (interface{}, error) {
 
 		for _, connection := range g.connectionsList {
 			if _, ok := users[connection.user]; !ok {
-				users[connection.user] = map[string]interface{}{
-					"id":       connection.user,
-					"address":  connection.remoteAddr.String(),
-					"location": connection.location,
-					"used":     connection.usage.used.Unix(),
+				users[connection.user] = &UserInfo{
+					ID:       connection.user,
+					Address:  connection.remoteAddr.String(),
+					Location: connection.location,
+					Used:     connection.usage.used.Unix(),
 				}
 			}
-			connectionsCount[connection.user]++
+			users[connection.user].ConnectionsCount++
 		}
 	}()
 
@@ -342,84 +707,70 @@ func (g *Gateway) ListUsers() (interface{}, error) {
 	}
 	for _, model := range models {
 		if _, ok := users[model.ID]; !ok {
-			users[model.ID] = map[string]interface{}{
-				"id":       model.ID,
-				"address":  model.Address,
-				"location": model.Location,
-				"used":     model.Used,
+			users[model.ID] = &UserInfo{
+				ID:       model.ID,
+				Address:  model.Address,
+				Location: model.Location,
+				Used:     model.Used,
 			}
 		}
-		users[model.ID]["database"] = true
+		users[model.ID].Database = true
 	}
 
 	// make it into a list
-	usersList := make([]interface{}, 0, len(users))
-	for id, user := range users {
-		user["connections_count"] = connectionsCount[id]
+	usersList := make([]*UserInfo, 0, len(users))
+	for _, user := range users {
 		usersList = append(usersList, user)
 	}
-	return map[string]interface{}{
-		"users": usersList,
-		"meta": map[string]interface{}{
-			"total_count": len(usersList),
-		},
-	}, nil
+	sort.Slice(usersList, func(i, j int) bool {
+		return usersList[i].ID < usersList[j].ID
+	})
+	return usersList, nil
 }
 
-func (g *Gateway) GetUser(id string) (interface{}, error) {
-	connections := make([]interface{}, 0)
-	user := map[string]interface{}{
-		"id": id,
+// get a user with its live connections, or nil when the user is unknown
+func (g *Gateway) GetUser(id string) (*UserInfo, error) {
+	user := &UserInfo{
+		ID:          id,
+		Connections: make([]*ConnectionInfo, 0),
 	}
 
-	func() {
-		g.lock.Lock()
-		defer g.lock.Unlock()
-
-		for _, connection := range g.connectionsList {
-			if connection.user != id {
-				continue
-			}
-			if len(connections) == 0 {
-				user["address"] = connection.remoteAddr.String()
-				user["location"] = connection.location
-				user["used"] = connection.usage.used.Unix()
-			}
-			connectionStatus := connection.gatherStatus()
-			if connectionStatus["status"] != nil {
-				if _, ok := user["status"]; !ok {
-					user["status"] = connectionStatus["status"]
-				}
-			}
-			delete(connectionStatus, "status")
-			connections = append(connections, connectionStatus)
+	for _, connection := range g.Connections() {
+		if connection.user != id {
+			continue
 		}
-	}()
+		status := connection.gatherStatus()
+		if len(user.Connections) == 0 {
+			user.Address = status.Address
+			user.Location = status.Location
+			user.Used = status.Used
+		}
+		if status.Status != nil && user.Status == nil {
+			user.Status = status.Status
+		}
+		status.Status = nil
+		user.Connections = append(user.Connections, status)
+	}
+	user.ConnectionsCount = len(user.Connections)
 
 	model, err := g.database.getUser(id)
 	if err != nil {
 		return nil, err
 	}
-	if model == nil && len(connections) == 0 {
+	if model == nil && len(user.Connections) == 0 {
 		return nil, nil
 	}
 
 	if model != nil {
-		if len(connections) == 0 {
-			user["address"] = model.Address
-			user["location"] = model.Location
-			user["used"] = model.Used
+		if len(user.Connections) == 0 {
+			user.Address = model.Address
+			user.Location = model.Location
+			user.Used = model.Used
 		}
-		user["database"] = true
-		if model.Status != nil {
-			if _, ok := user["status"]; !ok {
-				user["status"] = model.Status
-			}
+		user.Database = true
+		if model.Status != nil && user.Status == nil {
+			user.Status = model.Status
 		}
 	}
-
-	user["connections"] = connections
-	return map[string]interface{}{
-		"user": user,
-	}, nil
+	return user, nil
 }
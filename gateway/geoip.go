@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// how often database files are checked for updates, such as those written by geoipupdate
+const geoipReloadInterval = 10 * time.Second
+
+// how long lookup results are cached per address, and how many of them
+const (
+	geoipCacheTTL  = 5 * time.Minute
+	geoipCacheSize = 10000
+)
+
+// a geoip database file opened once and shared by all connections, reopened when the file
+// changes, a failed reopen keeps the previous database
+type geoipDatabase struct {
+	filename   string
+	reader     *geoip2.Reader
+	modified   time.Time
+	checked    time.Time
+	failure    string
+	cache      map[string]*geoipCacheEntry
+	lock       *sync.Mutex
+	readerLock *sync.RWMutex
+}
+
+type geoipCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// opens the database file, a missing file is logged and opened once it appears
+func newGeoipDatabase(filename string) *geoipDatabase {
+	d := &geoipDatabase{
+		filename:   filename,
+		cache:      make(map[string]*geoipCacheEntry),
+		lock:       &sync.Mutex{},
+		readerLock: &sync.RWMutex{},
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.reload()
+	return d
+}
+
+// reopen the file when it changed since it was opened, must hold the lock
+func (d *geoipDatabase) reload() {
+	d.checked = time.Now()
+
+	info, err := os.Stat(d.filename)
+	if err != nil {
+		d.failed(err)
+		return
+	}
+	if d.reader != nil && info.ModTime().Equal(d.modified) {
+		return
+	}
+
+	reader, err := geoip2.Open(d.filename)
+	if err != nil {
+		d.failed(err)
+		return
+	}
+
+	// lookups in progress finish with the previous reader before it is closed
+	d.readerLock.Lock()
+	previous := d.reader
+	d.reader = reader
+	d.readerLock.Unlock()
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			log.Warningf("geoip: failed to close database file %s: %s", d.filename, err)
+		}
+		log.Noticef("geoip: reloaded database file %s", d.filename)
+	} else {
+		log.Infof("geoip: opened database file %s", d.filename)
+	}
+	d.modified = info.ModTime()
+	d.failure = ""
+	d.cache = make(map[string]*geoipCacheEntry)
+}
+
+// log a failure to open the file once, until it changes
+func (d *geoipDatabase) failed(err error) {
+	if d.failure == err.Error() {
+		return
+	}
+	d.failure = err.Error()
+	if d.reader != nil {
+		log.Errorf("geoip: failed to reload database file %s, keeping the previous one: %s", d.filename, err)
+	} else {
+		log.Warningf("geoip: failed to open database file %s: %s", d.filename, err)
+	}
+}
+
+// look up the address, the result is cached by kind and address, nil when unknown
+func (d *geoipDatabase) lookup(kind string, ip net.IP, lookup func(*geoip2.Reader) (interface{}, error)) interface{} {
+	if d == nil {
+		return nil
+	}
+	key := kind + " " + ip.String()
+
+	d.lock.Lock()
+	if time.Since(d.checked) >= geoipReloadInterval {
+		d.reload()
+	}
+	if entry, ok := d.cache[key]; ok && time.Now().Before(entry.expires) {
+		d.lock.Unlock()
+		return entry.value
+	}
+	d.lock.Unlock()
+
+	var value interface{}
+	d.readerLock.RLock()
+	if d.reader != nil {
+		if result, err := lookup(d.reader); err == nil {
+			value = result
+		}
+	}
+	d.readerLock.RUnlock()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	if len(d.cache) >= geoipCacheSize {
+		for key, entry := range d.cache {
+			if !now.Before(entry.expires) {
+				delete(d.cache, key)
+			}
+		}
+		if len(d.cache) >= geoipCacheSize {
+			d.cache = make(map[string]*geoipCacheEntry)
+		}
+	}
+	d.cache[key] = &geoipCacheEntry{
+		value:   value,
+		expires: now.Add(geoipCacheTTL),
+	}
+	return value
+}
+
+func (d *geoipDatabase) city(ip net.IP) *geoip2.City {
+	city, _ := d.lookup("city", ip, func(reader *geoip2.Reader) (interface{}, error) {
+		return reader.City(ip)
+	}).(*geoip2.City)
+	return city
+}
+
+func (d *geoipDatabase) asn(ip net.IP) *geoip2.ASN {
+	asn, _ := d.lookup("asn", ip, func(reader *geoip2.Reader) (interface{}, error) {
+		return reader.ASN(ip)
+	}).(*geoip2.ASN)
+	return asn
+}
+
+func (d *geoipDatabase) isp(ip net.IP) *geoip2.ISP {
+	isp, _ := d.lookup("isp", ip, func(reader *geoip2.Reader) (interface{}, error) {
+		return reader.ISP(ip)
+	}).(*geoip2.ISP)
+	return isp
+}
+
+func (d *geoipDatabase) connectionType(ip net.IP) *geoip2.ConnectionType {
+	connectionType, _ := d.lookup("connection-type", ip, func(reader *geoip2.Reader) (interface{}, error) {
+		return reader.ConnectionType(ip)
+	}).(*geoip2.ConnectionType)
+	return connectionType
+}
+
+func (d *geoipDatabase) Close() {
+	if d == nil {
+		return
+	}
+	d.readerLock.Lock()
+	defer d.readerLock.Unlock()
+
+	if d.reader != nil {
+		if err := d.reader.Close(); err != nil {
+			log.Warningf("geoip: failed to close database file %s: %s", d.filename, err)
+		}
+		d.reader = nil
+	}
+}
+
+func lookupLocation(d *geoipDatabase, ip net.IP) *Location {
+	r := d.city(ip)
+	if r == nil {
+		return nil
+	}
+
+	if r.Country.IsoCode == "" {
+		return nil
+	}
+
+	if r.Location.Latitude == 0 && r.Location.Longitude == 0 {
+		return nil
+	}
+
+	location := &Location{
+		Country:   r.Country.IsoCode,
+		City:      r.City.Names["en"],
+		Timezone:  r.Location.TimeZone,
+		Latitude:  r.Location.Latitude,
+		Longitude: r.Location.Longitude,
+	}
+	if len(r.Subdivisions) > 0 {
+		location.Subdivision = r.Subdivisions[0].Names["en"]
+	}
+	return location
+}
+
+// add the autonomous system, isp and connection type of the address to its location,
+// which is created when the address has none but its network is known
+func lookupNetwork(asn, connectionType *geoipDatabase, ip net.IP, location *Location) *Location {
+	network := &Location{}
+	if r := asn.isp(ip); r != nil {
+		network.ASN = r.AutonomousSystemNumber
+		network.Organization = r.AutonomousSystemOrganization
+		network.ISP = r.ISP
+	} else if r := asn.asn(ip); r != nil {
+		network.ASN = r.AutonomousSystemNumber
+		network.Organization = r.AutonomousSystemOrganization
+	}
+	if r := connectionType.connectionType(ip); r != nil {
+		network.ConnectionType = r.ConnectionType
+	}
+
+	if *network == (Location{}) {
+		return location
+	}
+	if location == nil {
+		return network
+	}
+	enriched := *location
+	enriched.ASN = network.ASN
+	enriched.Organization = network.Organization
+	enriched.ISP = network.ISP
+	enriched.ConnectionType = network.ConnectionType
+	return &enriched
+}
+
+// the iso country code of the address, empty when unknown
+func lookupCountry(d *geoipDatabase, ip net.IP) string {
+	r := d.city(ip)
+	if r == nil {
+		return ""
+	}
+	return r.Country.IsoCode
+}
+
+// the autonomous system number of the address, zero when unknown
+func lookupASN(d *geoipDatabase, ip net.IP) uint {
+	if r := d.isp(ip); r != nil {
+		return r.AutonomousSystemNumber
+	}
+	r := d.asn(ip)
+	if r == nil {
+		return 0
+	}
+	return r.AutonomousSystemNumber
+}
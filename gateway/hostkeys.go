@@ -0,0 +1,194 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrNoHostKey         = errors.New("gatewaysshd: no private key for host certificate")
+	ErrInvalidHostKeys   = errors.New("gatewaysshd: invalid host keys request")
+	ErrUnknownHostKey    = errors.New("gatewaysshd: unknown host key")
+	ErrNoHostCertificate = errors.New("gatewaysshd: no host certificate")
+)
+
+// openssh extensions that let clients learn all host keys and update known hosts during rotations
+const (
+	requestHostKeys      = "hostkeys-00@openssh.com"
+	requestHostKeysProve = "hostkeys-prove-00@openssh.com"
+)
+
+// the host keys of the gateway, the certificates are presented during handshakes,
+// while the plain keys are announced to clients and prove ownership when asked
+type hostKeys struct {
+	certificates []ssh.Signer
+	keys         []ssh.Signer
+}
+
+// parse host certificates, one per line, and host private keys, one pem block each,
+// every certificate must be valid, not revoked, and have its private key
+func loadHostKeys(hostCertificates, hostPrivateKeys []byte, certificates *CertificateAuthenticator) (*hostKeys, error) {
+	// parse host keys
+	var keys []ssh.Signer
+	for {
+		block, rest := pem.Decode(hostPrivateKeys)
+		if block == nil {
+			break
+		}
+		key, err := ssh.ParsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("auth: host_public_key = %v", key.PublicKey())
+		keys = append(keys, key)
+		hostPrivateKeys = rest
+	}
+
+	// parse host certificates, and pair them with their keys
+	result := &hostKeys{}
+	for len(bytes.TrimSpace(hostCertificates)) > 0 {
+		parsed, _, _, rest, err := ssh.ParseAuthorizedKey(hostCertificates)
+		if err != nil {
+			return nil, err
+		}
+		hostCertificates = rest
+
+		cert, ok := parsed.(*ssh.Certificate)
+		if !ok {
+			return nil, ErrInvalidCertificate
+		}
+
+		principal := "localhost"
+		if len(cert.ValidPrincipals) > 0 {
+			principal = cert.ValidPrincipals[0]
+		}
+
+		var key ssh.Signer
+		for _, candidate := range keys {
+			if bytes.Equal(candidate.PublicKey().Marshal(), cert.Key.Marshal()) {
+				key = candidate
+				break
+			}
+		}
+		if key == nil {
+			return nil, ErrNoHostKey
+		}
+
+		// create signer for host
+		host, err := ssh.NewCertSigner(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		// test the host certificate
+		log.Debugf("auth: testing host certificate using principal: %s", principal)
+		if err := certificates.checkCertificate(principal, cert); err != nil {
+			return nil, err
+		}
+
+		result.certificates = append(result.certificates, host)
+		if result.find(key.PublicKey().Marshal()) == nil {
+			result.keys = append(result.keys, key)
+		}
+	}
+	if len(result.certificates) == 0 {
+		return nil, ErrNoHostCertificate
+	}
+	if len(keys) > len(result.keys) {
+		log.Warningf("auth: ignoring %d host private keys without certificate", len(keys)-len(result.keys))
+	}
+	return result, nil
+}
+
+// the key with the public key blob, nil when there is none
+func (h *hostKeys) find(blob []byte) ssh.Signer {
+	for _, key := range h.keys {
+		if bytes.Equal(key.PublicKey().Marshal(), blob) {
+			return key
+		}
+	}
+	return nil
+}
+
+// tell the client about all host keys, so that it can learn new ones before they are used
+func (c *Connection) announceHostKeys() {
+	hostKeys := c.gateway.currentHostKeys()
+	blobs := make([][]byte, 0, len(hostKeys.keys))
+	for _, key := range hostKeys.keys {
+		blobs = append(blobs, key.PublicKey().Marshal())
+	}
+
+	if _, _, err := c.conn.SendRequest(requestHostKeys, false, marshalStrings(blobs)); err != nil {
+		log.Debugf("failed to announce host keys: %s", err)
+	}
+}
+
+// sign each of the host keys requested by the client together with the session id
+func (c *Connection) proveHostKeys(payload []byte) ([]byte, error) {
+	blobs, err := unmarshalStrings(payload)
+	if err != nil || len(blobs) == 0 {
+		return nil, ErrInvalidHostKeys
+	}
+
+	hostKeys := c.gateway.currentHostKeys()
+	signatures := make([][]byte, 0, len(blobs))
+	for _, blob := range blobs {
+		key := hostKeys.find(blob)
+		if key == nil {
+			return nil, ErrUnknownHostKey
+		}
+
+		data := ssh.Marshal(&struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{requestHostKeysProve, c.conn.SessionID(), blob})
+
+		// rsa keys sign with sha-512 like openssh does
+		var signature *ssh.Signature
+		if signer, ok := key.(ssh.AlgorithmSigner); ok && key.PublicKey().Type() == ssh.KeyAlgoRSA {
+			signature, err = signer.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			signature, err = key.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, ssh.Marshal(signature))
+	}
+	return marshalStrings(signatures), nil
+}
+
+// encode a sequence of ssh strings
+func marshalStrings(values [][]byte) []byte {
+	var buffer []byte
+	for _, value := range values {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(value)))
+		buffer = append(append(buffer, length...), value...)
+	}
+	return buffer
+}
+
+// decode a sequence of ssh strings
+func unmarshalStrings(payload []byte) ([][]byte, error) {
+	var values [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, ErrInvalidHostKeys
+		}
+		length := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < length {
+			return nil, ErrInvalidHostKeys
+		}
+		values = append(values, payload[:length])
+		payload = payload[length:]
+	}
+	return values, nil
+}
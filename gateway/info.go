@@ -0,0 +1,254 @@
+package gateway
+
+import (
+	"encoding/json"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// a user known to the gateway, online or not
+type UserInfo struct {
+	ID string `json:"id"`
+
+	// ip address and geo location of the most recent connection
+	Address  string    `json:"address"`
+	Location *Location `json:"location"`
+
+	// last used timestamp
+	Used int64 `json:"used"`
+
+	// whether the user is stored in the database
+	Database bool `json:"database,omitempty"`
+
+	// number of live connections
+	ConnectionsCount int `json:"connections_count"`
+
+	// the live connections, only set when getting a single user
+	Connections []*ConnectionInfo `json:"connections,omitempty"`
+
+	// the last status reported by the user, only set when getting a single user
+	Status json.RawMessage `json:"status,omitempty"`
+}
+
+// geo location and network of an ip address
+type Location struct {
+	Country     string  `json:"country"`
+	Subdivision string  `json:"subdivision,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Timezone    string  `json:"timezone,omitempty"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+
+	// the network of the address, from the optional asn or isp and connection type databases
+	ASN            uint   `json:"asn,omitempty"`
+	Organization   string `json:"organization,omitempty"`
+	ISP            string `json:"isp,omitempty"`
+	ConnectionType string `json:"connection_type,omitempty"`
+}
+
+// the state of the whole gateway
+type GatewayInfo struct {
+	Connections []*ConnectionInfo `json:"connections"`
+}
+
+// the state of a live ssh connection
+type ConnectionInfo struct {
+	ID             string         `json:"id"`
+	User           string         `json:"user"`
+	Admin          bool           `json:"admin"`
+	Address        string         `json:"address"`
+	Location       *Location      `json:"location"`
+	Sessions       []*SessionInfo `json:"sessions"`
+	SessionsClosed uint64         `json:"sessions_closed"`
+	Tunnels        []*TunnelInfo  `json:"tunnels"`
+	TunnelsClosed  uint64         `json:"tunnels_closed"`
+	Created        int64          `json:"created"`
+	Used           int64          `json:"used"`
+	UpTime         uint64         `json:"up_time"`
+	IdleTime       uint64         `json:"idle_time"`
+	BytesRead      uint64         `json:"bytes_read"`
+	BytesWritten   uint64         `json:"bytes_written"`
+
+	// advertised ports by host
+	Services map[string][]uint16 `json:"services"`
+
+	// the last status reported by the client
+	Status json.RawMessage `json:"status,omitempty"`
+
+	// sha256 fingerprint of the key the user logged in with, the certified key for certificates
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// the certificate the user logged in with, if any
+	Certificate *CertificateInfo `json:"certificate,omitempty"`
+
+	// when the certificate the user logged in with expires, zero when never or without a certificate
+	CertificateExpires int64 `json:"certificate_expires,omitempty"`
+
+	// problems that need attention, such as a certificate about to expire
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// the certificate a connection was authorized with
+type CertificateInfo struct {
+	KeyID      string   `json:"key_id"`
+	Serial     uint64   `json:"serial"`
+	Principals []string `json:"principals"`
+
+	// validity window as unix timestamps, valid before is zero when valid forever
+	ValidAfter  int64 `json:"valid_after"`
+	ValidBefore int64 `json:"valid_before"`
+
+	// sha256 fingerprint of the certificate authority that signed it
+	CAFingerprint string `json:"ca_fingerprint"`
+
+	CriticalOptions map[string]string `json:"critical_options,omitempty"`
+	Extensions      map[string]string `json:"extensions"`
+}
+
+func newCertificateInfo(cert *ssh.Certificate) *CertificateInfo {
+	info := &CertificateInfo{
+		KeyID:           cert.KeyId,
+		Serial:          cert.Serial,
+		Principals:      cert.ValidPrincipals,
+		ValidAfter:      int64(cert.ValidAfter),
+		CAFingerprint:   ssh.FingerprintSHA256(cert.SignatureKey),
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		info.ValidBefore = int64(cert.ValidBefore)
+	}
+	return info
+}
+
+// the country code of the connection, empty when unknown
+func (c *ConnectionInfo) Country() string {
+	if c.Location == nil {
+		return ""
+	}
+	return c.Location.Country
+}
+
+// a session channel within a connection
+type SessionInfo struct {
+	Type string `json:"type"`
+}
+
+// a tunnel channel within a connection
+type TunnelInfo struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Connection string `json:"connection"`
+	User       string `json:"user"`
+
+	// the originating address given by the client that opened the tunnel
+	Origin string `json:"origin,omitempty"`
+
+	// the service the tunnel is for
+	Service *TunnelService `json:"service,omitempty"`
+
+	// the other end of the tunnel, from is set on the side of the service,
+	// to is set on the side of the client that opened it
+	From *TunnelEndpoint `json:"from,omitempty"`
+	To   *TunnelEndpoint `json:"to,omitempty"`
+}
+
+// a service as requested when opening a tunnel
+type TunnelService struct {
+	Host string `json:"host"`
+	Port uint32 `json:"port"`
+}
+
+// the connection on one end of a tunnel
+type TunnelEndpoint struct {
+	User    string `json:"user"`
+	Address string `json:"address"`
+}
+
+// a service advertised by a connection, named <host>.<user>
+type ServiceInfo struct {
+	Name         string   `json:"name"`
+	Host         string   `json:"host"`
+	User         string   `json:"user"`
+	Ports        []uint16 `json:"ports"`
+	Connection   string   `json:"connection"`
+	Address      string   `json:"address"`
+	Registered   int64    `json:"registered"`
+	UpTime       uint64   `json:"up_time"`
+	TunnelsCount int      `json:"tunnels_count"`
+}
+
+// returns the state of the whole gateway
+func (g *Gateway) Status() *GatewayInfo {
+	return &GatewayInfo{
+		Connections: g.ListConnections(),
+	}
+}
+
+// returns the state of all live connections
+func (g *Gateway) ListConnections() []*ConnectionInfo {
+	connections := g.Connections()
+	infos := make([]*ConnectionInfo, 0, len(connections))
+	for _, connection := range connections {
+		infos = append(infos, connection.gatherStatus())
+	}
+	return infos
+}
+
+// returns the state of a live connection, or nil when there is no such connection
+func (g *Gateway) GetConnection(id string) *ConnectionInfo {
+	for _, connection := range g.Connections() {
+		if connection.id == id {
+			return connection.gatherStatus()
+		}
+	}
+	return nil
+}
+
+// returns all services advertised by live connections
+func (g *Gateway) ListServices() []*ServiceInfo {
+	infos := make([]*ServiceInfo, 0)
+	for _, connection := range g.Connections() {
+		infos = append(infos, connection.gatherServices()...)
+	}
+	return infos
+}
+
+// returns all open tunnels of live connections
+func (g *Gateway) ListTunnels() []*TunnelInfo {
+	infos := make([]*TunnelInfo, 0)
+	for _, connection := range g.Connections() {
+		for _, tunnel := range connection.Tunnels() {
+			infos = append(infos, tunnel.gatherStatus())
+		}
+	}
+	return infos
+}
+
+// a public key a user may log in with instead of a certificate
+type KeyInfo struct {
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"public_key"`
+	Label       string `json:"label,omitempty"`
+	Admin       bool   `json:"admin"`
+	Created     int64  `json:"created"`
+	Expires     int64  `json:"expires,omitempty"`
+	LastUsed    int64  `json:"last_used,omitempty"`
+}
+
+// a certificate issued by the gateway, as recorded for auditing
+type IssuedCertificateInfo struct {
+	Serial      uint64            `json:"serial"`
+	KeyID       string            `json:"key_id"`
+	Principals  []string          `json:"principals"`
+	Fingerprint string            `json:"fingerprint"`
+	Extensions  map[string]string `json:"extensions"`
+	ValidAfter  int64             `json:"valid_after"`
+	ValidBefore int64             `json:"valid_before"`
+	Issued      int64             `json:"issued"`
+
+	// why the certificate was issued, such as enrollment, and the address it was issued to
+	Reason  string `json:"reason"`
+	Address string `json:"address"`
+}
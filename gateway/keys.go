@@ -0,0 +1,272 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrKeyExpired = errors.New("gatewaysshd: key expired")
+	ErrInvalidKey = errors.New("gatewaysshd: invalid key, certificates cannot be added")
+	ErrNoDatabase = errors.New("gatewaysshd: no database")
+)
+
+// the user that devices log in as to enroll their key with a one-time token
+const enrollUser = "enroll"
+
+// options of a key added to the database
+type KeyOptions struct {
+	Label string
+
+	// grants the user access to all services
+	Admin bool
+
+	// when the key stops being accepted, zero means never
+	Expires time.Time
+}
+
+// accepts public keys enrolled in the database
+type DatabaseAuthenticator struct {
+	database *Database
+}
+
+func NewDatabaseAuthenticator(database *Database) *DatabaseAuthenticator {
+	return &DatabaseAuthenticator{
+		database: database,
+	}
+}
+
+func (a *DatabaseAuthenticator) Authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	model, err := a.database.getKey(meta.User(), ssh.FingerprintSHA256(key))
+	if err != nil {
+		log.Errorf("auth: failed to look up key in database: %s", err)
+		return nil, err
+	}
+	if model == nil {
+		return nil, ErrUnknownKey
+	}
+
+	// the fingerprint matched, but make sure it is really the same key
+	stored, _, _, _, err := ssh.ParseAuthorizedKey([]byte(model.PublicKey))
+	if err != nil || !bytes.Equal(stored.Marshal(), key.Marshal()) {
+		return nil, ErrUnknownKey
+	}
+
+	if model.Expires != 0 && time.Now().Unix() > model.Expires {
+		return nil, ErrKeyExpired
+	}
+	return newPermissions(model.Admin), nil
+}
+
+// record when a key in the database was last used, called once the handshake completed, since
+// clients may offer keys without proving they hold the private key
+func (g *Gateway) keyUsed(user string, key ssh.PublicKey) {
+	if g.database == nil {
+		return
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	model, err := g.database.getKey(user, fingerprint)
+	if err != nil || model == nil {
+		return
+	}
+	if err := g.database.touchKey(user, fingerprint, time.Now().Unix()); err != nil {
+		log.Warningf("auth: failed to update key last used time: %s", err)
+	}
+}
+
+func newKeyModel(user string, key ssh.PublicKey, options *KeyOptions) *keyModel {
+	model := &keyModel{
+		User:        user,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		PublicKey:   string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))),
+		Created:     time.Now().Unix(),
+	}
+	if options != nil {
+		model.Label = options.Label
+		model.Admin = options.Admin
+		if !options.Expires.IsZero() {
+			model.Expires = options.Expires.Unix()
+		}
+	}
+	return model
+}
+
+func (m *keyModel) info() *KeyInfo {
+	return &KeyInfo{
+		User:        m.User,
+		Fingerprint: m.Fingerprint,
+		PublicKey:   m.PublicKey,
+		Label:       m.Label,
+		Admin:       m.Admin,
+		Created:     m.Created,
+		Expires:     m.Expires,
+		LastUsed:    m.LastUsed,
+	}
+}
+
+// add a public key the user may log in with
+func (g *Gateway) AddKey(user string, key ssh.PublicKey, options *KeyOptions) (*KeyInfo, error) {
+	if g.database == nil {
+		return nil, ErrNoDatabase
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, ErrInvalidKey
+	}
+
+	model := newKeyModel(user, key, options)
+	if err := g.database.addKey(model); err != nil {
+		return nil, err
+	}
+	log.Noticef("key added: user = %s, fingerprint = %s, label = %s, admin = %v", model.User, model.Fingerprint, model.Label, model.Admin)
+	return model.info(), nil
+}
+
+// list keys of a user, or of all users when user is empty
+func (g *Gateway) ListKeys(user string) ([]*KeyInfo, error) {
+	if g.database == nil {
+		return nil, ErrNoDatabase
+	}
+
+	models, err := g.database.listKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*KeyInfo, 0, len(models))
+	for _, model := range models {
+		keys = append(keys, model.info())
+	}
+	return keys, nil
+}
+
+// delete a key by its sha256 fingerprint, returns false when there is no such key,
+// existing connections are not affected
+func (g *Gateway) DeleteKey(user, fingerprint string) (bool, error) {
+	if g.database == nil {
+		return false, ErrNoDatabase
+	}
+
+	deleted, err := g.database.deleteKey(user, fingerprint)
+	if err != nil {
+		return false, err
+	}
+	if deleted {
+		log.Noticef("key deleted: user = %s, fingerprint = %s", user, fingerprint)
+	}
+	return deleted, nil
+}
+
+// create a one-time token that enrolls the key of whoever uses it for the user,
+// by running "ssh enroll@gateway enroll <token>" before the token expires
+func (g *Gateway) CreateEnrollmentToken(user string, validity time.Duration, options *KeyOptions) (string, error) {
+	enrollment := &enrollmentModel{
+		User: user,
+	}
+	if options != nil {
+		enrollment.Label = options.Label
+		enrollment.Admin = options.Admin
+		if !options.Expires.IsZero() {
+			enrollment.KeyExpires = options.Expires.Unix()
+		}
+	}
+	token, err := g.createEnrollmentToken(enrollment, validity)
+	if err != nil {
+		return "", err
+	}
+	log.Noticef("enrollment token created: user = %s, label = %s, admin = %v, expires = %s", user, enrollment.Label, enrollment.Admin, time.Unix(enrollment.Expires, 0).Format(time.RFC3339))
+	return token, nil
+}
+
+func (g *Gateway) createEnrollmentToken(enrollment *enrollmentModel, validity time.Duration) (string, error) {
+	if g.database == nil {
+		return "", ErrNoDatabase
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+
+	now := time.Now()
+	enrollment.Expires = now.Add(validity).Unix()
+	enrollment.Created = now.Unix()
+	if err := g.database.addEnrollment(hashToken(token), enrollment); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// redeem a one-time token for the key, which either enrolls the key in the database,
+// or issues a certificate for it when the token was created for a certificate
+func (g *Gateway) enroll(token string, key ssh.PublicKey, address string) (*KeyInfo, *ssh.Certificate, error) {
+	if g.database == nil {
+		return nil, nil, ErrNoDatabase
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, nil, ErrInvalidKey
+	}
+
+	var info *KeyInfo
+	var request *certificateRequest
+	if err := g.database.redeemEnrollment(hashToken(token), func(tx *bolt.Tx, enrollment *enrollmentModel) error {
+		if enrollment.Certificate {
+			if g.authority == nil {
+				return ErrNoSigningKey
+			}
+			options := &CertificateOptions{
+				Admin:    enrollment.Admin,
+				Validity: time.Duration(enrollment.Validity) * time.Second,
+			}
+			request = &certificateRequest{
+				authority:  g.authority,
+				key:        key,
+				keyID:      enrollment.User,
+				principals: []string{enrollment.User},
+				extensions: g.authority.extensionsFor(options),
+				validity:   g.authority.validityFor(options),
+				reason:     "enrollment",
+				address:    address,
+			}
+			return recordCertificate(tx, request.sign)
+		}
+
+		options := &KeyOptions{
+			Label: enrollment.Label,
+			Admin: enrollment.Admin,
+		}
+		if enrollment.KeyExpires != 0 {
+			options.Expires = time.Unix(enrollment.KeyExpires, 0)
+		}
+		model := newKeyModel(enrollment.User, key, options)
+		if err := putKey(tx, model); err != nil {
+			return err
+		}
+		info = model.info()
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	if request != nil {
+		cert := request.certificate
+		log.Noticef("certificate issued: principal = %s, serial = %d, fingerprint = %s, remote = %s, valid_before = %s", cert.KeyId, cert.Serial, ssh.FingerprintSHA256(key), address, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+		return nil, cert, nil
+	}
+	log.Noticef("key enrolled: user = %s, fingerprint = %s, label = %s, admin = %v", info.User, info.Fingerprint, info.Label, info.Admin)
+	return info, nil, nil
+}
+
+// only the hash of a token is stored, so that a copy of the database cannot be used to enroll
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,265 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the handshake duration histogram buckets, in seconds
+var handshakeBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// counters accumulated over the lifetime of the gateway
+type metrics struct {
+	perUser           bool
+	authSuccesses     uint64
+	authFailures      map[string]uint64
+	tunnelFailures    map[string]uint64
+	rejected          map[string]uint64
+	scavenged         uint64
+	bytesRead         map[string]uint64
+	bytesWritten      map[string]uint64
+	handshakeBuckets  []uint64
+	handshakeCount    uint64
+	handshakeDuration float64
+	lock              *sync.Mutex
+}
+
+func newMetrics(perUser bool) *metrics {
+	return &metrics{
+		perUser:          perUser,
+		authFailures:     make(map[string]uint64),
+		tunnelFailures:   make(map[string]uint64),
+		rejected:         make(map[string]uint64),
+		bytesRead:        make(map[string]uint64),
+		bytesWritten:     make(map[string]uint64),
+		handshakeBuckets: make([]uint64, len(handshakeBuckets)),
+		lock:             &sync.Mutex{},
+	}
+}
+
+func (m *metrics) authSucceeded() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.authSuccesses++
+}
+
+func (m *metrics) authFailed(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.authFailures[authFailureReason(err)]++
+}
+
+func (m *metrics) tunnelFailed(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.tunnelFailures[reason]++
+}
+
+func (m *metrics) connectionRejected(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.rejected[reason]++
+}
+
+func (m *metrics) connectionScavenged() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.scavenged++
+}
+
+// keep the traffic of a closed connection, so that the counters never go down
+func (m *metrics) connectionClosed(user string, usage *usageStats) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user = m.userLabel(user)
+	m.bytesRead[user] += atomic.LoadUint64(&usage.bytesRead)
+	m.bytesWritten[user] += atomic.LoadUint64(&usage.bytesWritten)
+}
+
+func (m *metrics) handshakeCompleted(duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	seconds := duration.Seconds()
+	for i, bound := range handshakeBuckets {
+		if seconds <= bound {
+			m.handshakeBuckets[i]++
+		}
+	}
+	m.handshakeCount++
+	m.handshakeDuration += seconds
+}
+
+func (m *metrics) userLabel(user string) string {
+	if !m.perUser {
+		return ""
+	}
+	return user
+}
+
+// classify an authentication error into a low cardinality reason
+func authFailureReason(err error) string {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "denied by policy"):
+		return "policy"
+	case strings.Contains(message, "unrecognized authority"):
+		return "unknown_authority"
+	case strings.Contains(message, "revoked"):
+		return "revoked"
+	case strings.Contains(message, "principal"):
+		return "invalid_principal"
+	case strings.Contains(message, "expired"), strings.Contains(message, "not yet valid"):
+		return "expired"
+	case strings.Contains(message, "normal key pairs not accepted"), strings.Contains(message, "cert has type"):
+		return "not_certificate"
+	case strings.Contains(message, "source address"):
+		return "source_address"
+	case strings.Contains(message, "signature"):
+		return "invalid_signature"
+	case strings.Contains(message, "unknown user"), strings.Contains(message, "unknown public key"):
+		return "unknown_key"
+	case strings.Contains(message, "access denied"):
+		return "access_denied"
+	}
+	return "other"
+}
+
+// writes metrics in the prometheus text exposition format
+func (g *Gateway) WriteMetrics(writer io.Writer) error {
+	w := &metricsWriter{writer: writer}
+
+	connectionsCount := make(map[string]uint64)
+	bytesRead := make(map[string]uint64)
+	bytesWritten := make(map[string]uint64)
+	var sessions, tunnels, services uint64
+	bans := uint64(len(g.ListBans()))
+	if !g.metrics.perUser {
+		connectionsCount[""] = 0
+	}
+
+	// gauges are computed from the live state, traffic of live and closed
+	// connections is summed while holding the gateway lock so that a closing
+	// connection is never counted twice
+	g.lock.Lock()
+	for _, connection := range g.connectionsList {
+		user := g.metrics.userLabel(connection.user)
+		connectionsCount[user]++
+		bytesRead[user] += atomic.LoadUint64(&connection.usage.bytesRead)
+		bytesWritten[user] += atomic.LoadUint64(&connection.usage.bytesWritten)
+
+		sessions += uint64(len(connection.Sessions()))
+		tunnels += uint64(len(connection.Tunnels()))
+		for _, ports := range connection.Services() {
+			services += uint64(len(ports))
+		}
+	}
+	g.metrics.lock.Lock()
+	defer g.metrics.lock.Unlock()
+	g.lock.Unlock()
+
+	for user, value := range g.metrics.bytesRead {
+		bytesRead[user] += value
+	}
+	for user, value := range g.metrics.bytesWritten {
+		bytesWritten[user] += value
+	}
+	if !g.metrics.perUser {
+		bytesRead[""] += 0
+		bytesWritten[""] += 0
+	}
+
+	w.header("gatewaysshd_connections", "gauge", "Number of open ssh connections.")
+	w.values("gatewaysshd_connections", "user", connectionsCount)
+	w.header("gatewaysshd_sessions", "gauge", "Number of open sessions.")
+	w.value("gatewaysshd_sessions", "", sessions)
+	w.header("gatewaysshd_services", "gauge", "Number of registered service ports.")
+	w.value("gatewaysshd_services", "", services)
+	w.header("gatewaysshd_tunnels", "gauge", "Number of open tunnel channels.")
+	w.value("gatewaysshd_tunnels", "", tunnels)
+
+	w.header("gatewaysshd_auth_successes_total", "counter", "Number of successful authentications.")
+	w.value("gatewaysshd_auth_successes_total", "", g.metrics.authSuccesses)
+	w.header("gatewaysshd_auth_failures_total", "counter", "Number of failed authentication attempts by reason.")
+	w.values("gatewaysshd_auth_failures_total", "reason", g.metrics.authFailures)
+	w.header("gatewaysshd_tunnel_open_failures_total", "counter", "Number of tunnels that failed to open by reason.")
+	w.values("gatewaysshd_tunnel_open_failures_total", "reason", g.metrics.tunnelFailures)
+	w.header("gatewaysshd_rejected_connections_total", "counter", "Number of connections rejected by reason, such as banned or denied by the access policy.")
+	w.values("gatewaysshd_rejected_connections_total", "reason", g.metrics.rejected)
+	w.header("gatewaysshd_bans", "gauge", "Number of banned addresses and prefixes.")
+	w.value("gatewaysshd_bans", "", bans)
+	w.header("gatewaysshd_scavenged_connections_total", "counter", "Number of connections closed for being idle.")
+	w.value("gatewaysshd_scavenged_connections_total", "", g.metrics.scavenged)
+
+	w.header("gatewaysshd_bytes_read_total", "counter", "Number of bytes read from clients.")
+	w.values("gatewaysshd_bytes_read_total", "user", bytesRead)
+	w.header("gatewaysshd_bytes_written_total", "counter", "Number of bytes written to clients.")
+	w.values("gatewaysshd_bytes_written_total", "user", bytesWritten)
+
+	w.header("gatewaysshd_handshake_duration_seconds", "histogram", "Duration of ssh handshakes, including authentication.")
+	for i, bound := range handshakeBuckets {
+		w.value("gatewaysshd_handshake_duration_seconds_bucket", fmt.Sprintf("le=\"%g\"", bound), g.metrics.handshakeBuckets[i])
+	}
+	w.value("gatewaysshd_handshake_duration_seconds_bucket", "le=\"+Inf\"", g.metrics.handshakeCount)
+	w.line("gatewaysshd_handshake_duration_seconds_sum %g", g.metrics.handshakeDuration)
+	w.value("gatewaysshd_handshake_duration_seconds_count", "", g.metrics.handshakeCount)
+
+	return w.err
+}
+
+// writes lines of metrics, remembering the first error
+type metricsWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (w *metricsWriter) line(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.writer, format+"\n", args...)
+}
+
+func (w *metricsWriter) header(name, kind, help string) {
+	w.line("# HELP %s %s", name, help)
+	w.line("# TYPE %s %s", name, kind)
+}
+
+func (w *metricsWriter) value(name, labels string, value uint64) {
+	if labels != "" {
+		name = name + "{" + labels + "}"
+	}
+	w.line("%s %d", name, value)
+}
+
+// write one sample per label value, sorted, an empty label value is omitted
+func (w *metricsWriter) values(name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labels := ""
+		if key != "" {
+			labels = fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(key))
+		}
+		w.value(name, labels, values[key])
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrPolicyDenied         = errors.New("gatewaysshd: certificate denied by policy")
+	ErrInvalidPolicy        = errors.New("gatewaysshd: invalid certificate policy")
+	ErrDuplicateAuthority   = errors.New("gatewaysshd: certificate authority listed twice in policy")
+	ErrInvalidPolicyPattern = errors.New("gatewaysshd: invalid principal pattern in policy")
+)
+
+// what certificates signed by each certificate authority may do, replacing the default
+// rule where only the first certificate authority passes down permissions
+type CertificatePolicy struct {
+	Authorities []*AuthorityPolicy `yaml:"authorities"`
+}
+
+// rules for certificates signed by one certificate authority
+type AuthorityPolicy struct {
+	// a name for logging
+	Name string `yaml:"name"`
+
+	// the certificate authority in authorized keys format
+	PublicKey string `yaml:"public_key"`
+
+	// glob patterns of users that may log in, empty allows any principal of the certificate
+	Principals []string `yaml:"principals"`
+
+	// extensions passed down to the connection, such as permit-port-forwarding for admins,
+	// others are dropped, empty passes down none
+	Extensions []string `yaml:"extensions"`
+
+	// the longest validity period of a certificate, zero allows any
+	MaxValidity time.Duration `yaml:"max_validity"`
+
+	// require certificates to be bound to source addresses
+	RequireSourceAddress bool `yaml:"require_source_address"`
+
+	key ssh.PublicKey
+}
+
+// parse a certificate policy in yaml format, such as:
+//
+//	authorities:
+//	  - name: devices
+//	    public_key: ssh-ed25519 AAAA...
+//	    principals: ["device-*"]
+//	    extensions: [permit-pty]
+//	    max_validity: 8760h
+//	    require_source_address: false
+func ParseCertificatePolicy(data []byte) (*CertificatePolicy, error) {
+	var policy CertificatePolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+
+	for i, authority := range policy.Authorities {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authority.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := key.(*ssh.Certificate); ok || authority.MaxValidity < 0 {
+			return nil, ErrInvalidPolicy
+		}
+		for _, pattern := range authority.Principals {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, ErrInvalidPolicyPattern
+			}
+		}
+		for _, other := range policy.Authorities[:i] {
+			if bytes.Equal(other.key.Marshal(), key.Marshal()) {
+				return nil, ErrDuplicateAuthority
+			}
+		}
+		authority.key = key
+		if authority.Name == "" {
+			authority.Name = ssh.FingerprintSHA256(key)
+		}
+	}
+	return &policy, nil
+}
+
+// the rules for certificates signed by the certificate authority, nil when there are none
+func (p *CertificatePolicy) find(ca ssh.PublicKey) *AuthorityPolicy {
+	for _, authority := range p.Authorities {
+		if bytes.Equal(authority.key.Marshal(), ca.Marshal()) {
+			return authority
+		}
+	}
+	return nil
+}
+
+// check a certificate the user logs in with against the rules, returns the permissions passed down
+func (a *AuthorityPolicy) apply(user string, cert *ssh.Certificate, permissions *ssh.Permissions) (*ssh.Permissions, error) {
+	if len(a.Principals) > 0 {
+		if !matchesAny(a.Principals, user) {
+			log.Warningf("auth: policy %s does not allow user %s: key_id = %s, serial = %d", a.Name, user, cert.KeyId, cert.Serial)
+			return nil, ErrPolicyDenied
+		}
+	}
+
+	if a.MaxValidity > 0 {
+		if cert.ValidBefore == ssh.CertTimeInfinity || cert.ValidBefore < cert.ValidAfter || cert.ValidBefore-cert.ValidAfter > uint64(a.MaxValidity/time.Second) {
+			log.Warningf("auth: policy %s does not allow validity longer than %s: key_id = %s, serial = %d", a.Name, a.MaxValidity, cert.KeyId, cert.Serial)
+			return nil, ErrPolicyDenied
+		}
+	}
+
+	if a.RequireSourceAddress {
+		if _, ok := cert.CriticalOptions["source-address"]; !ok {
+			log.Warningf("auth: policy %s requires source-address: key_id = %s, serial = %d", a.Name, cert.KeyId, cert.Serial)
+			return nil, ErrPolicyDenied
+		}
+	}
+
+	allowed := &ssh.Permissions{
+		CriticalOptions: permissions.CriticalOptions,
+		Extensions:      make(map[string]string),
+	}
+	for _, name := range a.Extensions {
+		if value, ok := permissions.Extensions[name]; ok {
+			allowed.Extensions[name] = value
+		}
+	}
+	return allowed, nil
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestPolicy(t *testing.T, ca ssh.Signer, rules string) *CertificatePolicy {
+	policy, err := ParseCertificatePolicy([]byte("authorities:\n  - name: contractors\n    public_key: " + string(ssh.MarshalAuthorizedKey(ca.PublicKey())) + rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestCertificatePolicyDenied(t *testing.T) {
+	ca := newTestSigner(t)
+	certificates := newTestCertificateAuthenticator(t, ca)
+	certificates.SetPolicy(newTestPolicy(t, ca, `    principals: ["contractor-*"]
+    extensions: [permit-pty]
+    max_validity: 24h
+    require_source_address: true
+`))
+	authenticator := MultiAuthenticator{certificates, newAllowingHelper(t)}
+
+	sourceAddress := map[string]string{"source-address": "192.0.2.0/24"}
+	for name, test := range map[string]struct {
+		user string
+		cert *ssh.Certificate
+	}{
+		"principal":      {"admin", newTestCertificate(t, ca, "principal", "admin", time.Hour*2, sourceAddress)},
+		"validity":       {"contractor-1", newTestCertificate(t, ca, "validity", "contractor-1", time.Hour*48, sourceAddress)},
+		"source address": {"contractor-1", newTestCertificate(t, ca, "source-address", "contractor-1", time.Hour*2, nil)},
+	} {
+		if _, err := authenticator.Authenticate(newTestMetadata(test.user), test.cert); !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("certificate breaking the %s rule: expected %v, got %v", name, ErrPolicyDenied, err)
+		}
+	}
+
+	permissions, err := authenticator.Authenticate(newTestMetadata("contractor-1"), newTestCertificate(t, ca, "allowed", "contractor-1", time.Hour*2, sourceAddress))
+	if err != nil {
+		t.Fatalf("certificate following the rules was rejected: %s", err)
+	}
+	if isAdmin(permissions) {
+		t.Fatal("extension not allowed by the policy was passed down")
+	}
+}
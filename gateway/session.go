@@ -3,18 +3,58 @@ package gateway
 import (
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"strings"
 	"sync"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
+// exit statuses reported back to the client when a session is closed
+const (
+	exitSuccess          = 0
+	exitFailure          = 1
+	exitUsage            = 2
+	exitDataError        = 65
+	exitPermissionDenied = 77
+	exitUnknownCommand   = 127
+)
+
+// an error that carries the exit status of a failed command
+type commandError struct {
+	status  uint32
+	message string
+}
+
+func (e *commandError) Error() string {
+	return e.message
+}
+
+func commandFailed(status uint32, format string, args ...interface{}) error {
+	return &commandError{
+		status:  status,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
 // a session within a ssh connection
 type Session struct {
 	connection  *Connection
 	channel     ssh.Channel
 	channelType string
 	extraData   []byte
+	stdout      io.Writer
+	stderr      io.Writer
+	pty         *ptyRequest
+	terminal    *terminal.Terminal
+	table       bool
+	started     bool
+	exitStatus  uint32
+	done        chan struct{}
+	lock        *sync.Mutex
 	closeOnce   sync.Once
 }
 
@@ -25,17 +65,23 @@ func newSession(connection *Connection, channel ssh.Channel, channelType string,
 		channel:     channel,
 		channelType: channelType,
 		extraData:   extraData,
+		stdout:      channel,
+		stderr:      channel.Stderr(),
+		done:        make(chan struct{}),
+		lock:        &sync.Mutex{},
 	}
 }
 
 // close the session
 func (s *Session) Close() {
 	s.closeOnce.Do(func() {
+		close(s.done)
+
 		if err := s.channel.CloseWrite(); err != nil {
 			log.Warningf("failed to close session: %s", err)
 		}
 
-		if _, err := s.channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0}); err != nil {
+		if _, err := s.channel.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{s.exitStatus})); err != nil {
 			log.Warningf("failed to send exit-status for session: %s", err)
 		}
 
@@ -43,17 +89,53 @@ func (s *Session) Close() {
 			log.Warningf("failed to close session: %s", err)
 		}
 
-		log.Debugf("session closed: user = %s, remote = %v, type = %s", s.connection.user, s.connection.remoteAddr, s.channelType)
+		log.Debugf("session closed: user = %s, remote = %v, type = %s, exit_status = %d", s.connection.user, s.connection.remoteAddr, s.channelType, s.exitStatus)
 
 		s.connection.deleteSession(s)
 	})
 }
 
+// close the session with the exit status derived from the error,
+// a human readable message is sent to stderr on failure
+func (s *Session) exit(err error) {
+	defer s.Close()
+
+	if err == nil {
+		s.exitStatus = exitSuccess
+		return
+	}
+
+	s.exitStatus = exitFailure
+	if e, ok := err.(*commandError); ok {
+		s.exitStatus = e.status
+	}
+
+	log.Warningf("session command failed: user = %s, remote = %v, exit_status = %d, error = %s", s.connection.user, s.connection.remoteAddr, s.exitStatus, err)
+	if _, err := fmt.Fprintf(s.stderr, "gatewaysshd: %s\n", err); err != nil {
+		log.Warningf("failed to send error message: %s", err)
+	}
+}
+
+// send an out of band message to the client
+func (s *Session) notify(message string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writer := s.stderr
+	if s.terminal != nil {
+		writer = s.terminal
+	}
+	if _, err := fmt.Fprintf(writer, "gatewaysshd: %s\n", message); err != nil {
+		log.Debugf("failed to notify session: %s", err)
+	}
+}
+
 func (s *Session) handleRequests(requests <-chan *ssh.Request) {
 	defer s.Close()
 
+	// requests are handled in order, so that a pty is allocated before the shell starts
 	for request := range requests {
-		go s.handleRequest(request)
+		s.handleRequest(request)
 	}
 }
 
@@ -67,13 +149,15 @@ func (s *Session) handleRequest(request *ssh.Request) {
 		// just ignore the env settings from client
 		ok = true
 
-	case "shell":
-		// allow creating shell
-		ok = true
+	case "pty-req":
+		ok = s.allocatePty(request.Payload)
 
-	case "exec":
-		// allow execute command
-		ok = true
+	case "window-change":
+		ok = s.changeWindow(request.Payload)
+
+	case "shell", "exec":
+		// allow creating shell or executing command, but only once per session
+		ok = s.start()
 	}
 
 	// reply to client
@@ -83,111 +167,201 @@ func (s *Session) handleRequest(request *ssh.Request) {
 			return
 		}
 	}
+	if !ok {
+		return
+	}
 
 	// do actual work here
 	switch request.Type {
 	case "shell":
-		s.status()
+		if terminal := s.openTerminal(); terminal != nil {
+			go s.exit(s.shell(terminal))
+		} else if s.connection.enrolling {
+			go s.exit(commandFailed(exitUsage, "usage: %s", commands["enroll"].usage))
+		} else {
+			go s.exit(s.status(nil))
+		}
 
 	case "exec":
+		// without a terminal to do it, line endings are translated for the pty here
+		if s.pty != nil {
+			s.lock.Lock()
+			s.stdout = &crlfWriter{writer: s.channel}
+			s.stderr = &crlfWriter{writer: s.channel.Stderr()}
+			s.lock.Unlock()
+		}
 		r, err := unmarshalExecuteRequest(request.Payload)
 		if err != nil {
 			log.Warningf("invalid payload: %s", err)
+			go s.exit(commandFailed(exitUsage, "invalid exec request"))
 			break
 		}
 
-		switch r.Command {
-		case "ping":
-			s.ping()
-		case "status":
-			s.status()
-		case "reportStatus":
-			s.reportStatus()
+		go s.exit(s.execute(r.Command))
+	}
+}
+
+func (s *Session) start() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return false
+	}
+	s.started = true
+	return true
+}
+
+func (s *Session) allocatePty(payload []byte) bool {
+	request, err := unmarshalPtyRequest(payload)
+	if err != nil {
+		log.Warningf("failed to decode pty request: %s", err)
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return false
+	}
+	s.pty = request
+	return true
+}
+
+func (s *Session) changeWindow(payload []byte) bool {
+	request, err := unmarshalWindowChangeRequest(payload)
+	if err != nil {
+		log.Warningf("failed to decode window change request: %s", err)
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pty == nil {
+		return false
+	}
+	s.pty.Columns = request.Columns
+	s.pty.Rows = request.Rows
+	if s.terminal != nil {
+		if err := s.terminal.SetSize(int(request.Columns), int(request.Rows)); err != nil {
+			log.Warningf("failed to resize terminal: %s", err)
+		}
+	}
+	return true
+}
+
+// run a built-in command
+func (s *Session) execute(line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return commandFailed(exitUsage, "no command given")
+	}
+
+	// output is rendered as table on a terminal, unless overridden
+	s.table = s.pty != nil
+	for i := len(args) - 1; i > 0; i-- {
+		switch args[i] {
+		case "--json":
+			s.table = false
+		case "--table":
+			s.table = true
 		default:
-			defer s.Close()
+			continue
+		}
+		args = append(args[:i], args[i+1:]...)
+	}
 
-			// legacy behavior, command itself is json
-			var status json.RawMessage
-			if err := json.Unmarshal([]byte(r.Command), &status); err != nil {
-				log.Warningf("failed to unmarshal json: %s", err)
-				break
-			}
+	if command, ok := commands[args[0]]; ok {
+		if !s.permitCommand(command) {
+			return commandFailed(exitPermissionDenied, "permission denied: %s", args[0])
+		}
+		if err := command.run(s, args[1:]); err != errUsage {
+			return err
+		}
+		return commandFailed(exitUsage, "usage: %s", command.usage)
+	}
 
+	// devices may also enroll by running the token itself, as in "ssh enroll@gateway <token>"
+	if s.connection.enrolling && len(args) == 1 {
+		return s.enroll(args)
+	}
+
+	if s.connection.gateway.settings.AllowLegacyStatus && !s.connection.enrolling {
+		// legacy behavior, command itself is json
+		var status json.RawMessage
+		if err := json.Unmarshal([]byte(line), &status); err == nil {
 			s.connection.reportStatus(status)
 			s.connection.updateUser()
+			return nil
 		}
 	}
+
+	return commandFailed(exitUnknownCommand, "unknown command: %s", args[0])
 }
 
-func (s *Session) gatherStatus() map[string]interface{} {
-	return map[string]interface{}{
-		"type": s.channelType,
+func (s *Session) gatherStatus() *SessionInfo {
+	return &SessionInfo{
+		Type: s.channelType,
 	}
 }
 
-func (s *Session) ping() {
-	defer s.Close()
+func (s *Session) ping(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
 
-	if _, err := s.channel.Write([]byte("pong\n")); err != nil {
+	if _, err := s.stdout.Write([]byte("pong\n")); err != nil {
 		log.Warningf("failed to send status: %s", err)
-		return
+		return err
 	}
+	return nil
 }
 
-func (s *Session) status() {
-	defer s.Close()
+func (s *Session) status(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
 
-	var status map[string]interface{}
+	var status interface{}
 	if !s.connection.admin {
 		status = s.connection.gatherStatus()
 	} else {
-		status = s.connection.gateway.gatherStatus()
+		status = s.connection.gateway.Status()
 	}
 
-	encoded, err := json.MarshalIndent(status, "", "  ")
-	if err != nil {
-		log.Warningf("failed to marshal status: %s", err)
-		return
-	}
+	return s.writeJSON(status)
+}
 
-	if _, err := s.channel.Write(encoded); err != nil {
-		log.Warningf("failed to send status: %s", err)
-		return
+func (s *Session) reportStatus(args []string) error {
+	if len(args) > 0 {
+		return errUsage
 	}
 
-	if _, err := s.channel.Write([]byte("\n")); err != nil {
-		log.Warningf("failed to send status: %s", err)
-		return
+	reader, err := gzip.NewReader(s.channel)
+	if err != nil {
+		log.Warningf("failed to decompress: %s", err)
+		return commandFailed(exitDataError, "failed to decompress status: %s", err)
 	}
-}
-
-func (s *Session) reportStatus() {
-	go func() {
-		defer s.Close()
-
-		reader, err := gzip.NewReader(s.channel)
-		if err != nil {
-			log.Warningf("failed to decompress: %s", err)
-			return
-		}
-		defer reader.Close()
+	defer reader.Close()
 
-		// read all data from session
-		raw, err := ioutil.ReadAll(reader)
-		if err != nil {
-			log.Warningf("failed to read all: %s", err)
-			return
-		}
+	// read all data from session
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Warningf("failed to read all: %s", err)
+		return commandFailed(exitDataError, "failed to read status: %s", err)
+	}
 
-		// parse it in to json
-		var status json.RawMessage
-		if err := json.Unmarshal(raw, &status); err != nil {
-			log.Warningf("failed to unmarshal json: %s", err)
-			return
-		}
+	// parse it in to json
+	var status json.RawMessage
+	if err := json.Unmarshal(raw, &status); err != nil {
+		log.Warningf("failed to unmarshal json: %s", err)
+		return commandFailed(exitDataError, "invalid status json: %s", err)
+	}
 
-		// save the result
-		s.connection.reportStatus(status)
-		s.connection.updateUser()
-	}()
+	// save the result
+	s.connection.reportStatus(status)
+	s.connection.updateUser()
+	return nil
 }
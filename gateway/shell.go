@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// create a terminal on top of the session channel if a pty was requested
+func (s *Session) openTerminal() *terminal.Terminal {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pty == nil {
+		return nil
+	}
+
+	prompt := fmt.Sprintf("%s@gatewaysshd> ", s.connection.user)
+	s.terminal = terminal.NewTerminal(s.channel, prompt)
+	if err := s.terminal.SetSize(int(s.pty.Columns), int(s.pty.Rows)); err != nil {
+		log.Warningf("failed to resize terminal: %s", err)
+	}
+	s.terminal.AutoCompleteCallback = s.complete
+	return s.terminal
+}
+
+// run an interactive shell, reading one command per line
+func (s *Session) shell(terminal *terminal.Terminal) error {
+	log.Infof("shell started: user = %s, remote = %v, term = %s", s.connection.user, s.connection.remoteAddr, s.pty.Term)
+	s.stdout = terminal
+
+	fmt.Fprintf(terminal, "Welcome to gatewaysshd, %s. Type \"help\" for a list of commands.\n", s.connection.user)
+	for {
+		line, err := terminal.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		switch line {
+		case "":
+			continue
+		case "exit", "quit", "logout":
+			return nil
+		}
+
+		if err := s.execute(line); err != nil {
+			fmt.Fprintf(terminal, "error: %s\n", err)
+		}
+	}
+}
+
+// complete the command name when tab is pressed
+func (s *Session) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || pos != len(line) || strings.Contains(line, " ") {
+		return "", 0, false
+	}
+
+	var matches []string
+	for _, name := range s.commandNames() {
+		if strings.HasPrefix(name, line) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	if len(matches) == 1 {
+		return matches[0] + " ", len(matches[0]) + 1, true
+	}
+
+	// complete up to the longest common prefix
+	prefix := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) <= len(line) {
+		return "", 0, false
+	}
+	return prefix, len(prefix), true
+}
+
+// names of commands the user is allowed to run, sorted
+func (s *Session) commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name, command := range commands {
+		if !s.permitCommand(command) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// whether the user may run the command, enrolling connections may only enroll
+func (s *Session) permitCommand(command *command) bool {
+	if s.connection.enrolling {
+		return command.enrollment
+	}
+	return !command.admin || s.connection.admin
+}
+
+// write the value as indented json
+func (s *Session) writeJSON(value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Warningf("failed to marshal json: %s", err)
+		return err
+	}
+
+	if _, err := s.stdout.Write(append(encoded, '\n')); err != nil {
+		log.Warningf("failed to send json: %s", err)
+		return err
+	}
+	return nil
+}
+
+// write a table when a pty is present or requested, otherwise write the value as json
+func (s *Session) render(value interface{}, header []string, rows [][]string) error {
+	if !s.table {
+		return s.writeJSON(value)
+	}
+
+	writer := tabwriter.NewWriter(s.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
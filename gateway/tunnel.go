@@ -1,32 +1,60 @@
 package gateway
 
 import (
+	"fmt"
 	"io"
 	"sync"
 
+	"github.com/segmentio/ksuid"
 	"golang.org/x/crypto/ssh"
 )
 
 // a tunnel within a ssh connection
 type Tunnel struct {
+	id          string
 	connection  *Connection
 	channel     ssh.Channel
 	channelType string
 	extraData   []byte
 	active      bool
 	closeOnce   sync.Once
-	metadata    map[string]interface{}
+	metadata    *tunnelMetadata
 }
 
-func newTunnel(connection *Connection, channel ssh.Channel, channelType string, extraData []byte, metadata map[string]interface{}) *Tunnel {
-	log.Infof("new tunnel: user = %s, remote = %v, type = %s, metadata = %v", connection.user, connection.remoteAddr, channelType, metadata)
-	return &Tunnel{
+// what a tunnel is for and where it leads
+type tunnelMetadata struct {
+	origin  string
+	service *TunnelService
+	from    *TunnelEndpoint
+	to      *TunnelEndpoint
+}
+
+func newTunnel(connection *Connection, channel ssh.Channel, channelType string, extraData []byte, metadata *tunnelMetadata) *Tunnel {
+	tunnel := &Tunnel{
+		id:          ksuid.New().String(),
 		connection:  connection,
 		channel:     channel,
 		channelType: channelType,
 		extraData:   extraData,
 		metadata:    metadata,
 	}
+	service, peer := tunnel.describe()
+	log.Infof("new tunnel: user = %s, remote = %v, type = %s, service = %s, peer = %s", connection.user, connection.remoteAddr, channelType, service, peer)
+	return tunnel
+}
+
+// notify the client with the reason, then close the tunnel
+func (t *Tunnel) Disconnect(reason string) {
+	log.Noticef("closing tunnel: id = %s, user = %s, remote = %v, reason = %s", t.id, t.connection.user, t.connection.remoteAddr, reason)
+
+	// clients that understand it can pick up the reason from a channel request
+	if _, err := t.channel.SendRequest("disconnect@gatewaysshd", false, marshalDisconnectRequest(&disconnectRequest{
+		Reason: reason,
+	})); err != nil {
+		log.Debugf("failed to send disconnect request: %s", err)
+	}
+
+	t.Close()
 }
 
 // close the tunnel
@@ -36,7 +64,8 @@ func (t *Tunnel) Close() {
 			log.Warningf("failed to close tunnel: %s", err)
 		}
 
-		log.Infof("tunnel closed: user = %s, remote = %v, type = %s, metadata = %v", t.connection.user, t.connection.remoteAddr, t.channelType, t.metadata)
+		service, peer := t.describe()
+		log.Infof("tunnel closed: user = %s, remote = %v, type = %s, service = %s, peer = %s", t.connection.user, t.connection.remoteAddr, t.channelType, service, peer)
 
 		t.connection.deleteTunnel(t)
 	})
@@ -84,12 +113,32 @@ func (t *Tunnel) handleTunnel(t2 *Tunnel) {
 	}
 }
 
-func (t *Tunnel) gatherStatus() map[string]interface{} {
-	status := map[string]interface{}{
-		"type": t.channelType,
+func (t *Tunnel) gatherStatus() *TunnelInfo {
+	return &TunnelInfo{
+		ID:         t.id,
+		Type:       t.channelType,
+		Connection: t.connection.id,
+		User:       t.connection.user,
+		Origin:     t.metadata.origin,
+		Service:    t.metadata.service,
+		From:       t.metadata.from,
+		To:         t.metadata.to,
+	}
+}
+
+// summarize the service and the peer of the tunnel
+func (t *Tunnel) describe() (string, string) {
+	service := ""
+	if t.metadata.service != nil {
+		service = fmt.Sprintf("%s:%d", t.metadata.service.Host, t.metadata.service.Port)
+	}
+
+	peer := ""
+	if t.metadata.from != nil {
+		peer = fmt.Sprintf("from %s@%s", t.metadata.from.User, t.metadata.from.Address)
 	}
-	for k, v := range t.metadata {
-		status[k] = v
+	if t.metadata.to != nil {
+		peer = fmt.Sprintf("to %s@%s", t.metadata.to.User, t.metadata.to.Address)
 	}
-	return status
+	return service, peer
 }
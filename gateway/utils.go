@@ -1,12 +1,14 @@
 package gateway
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
-	"github.com/oschwald/geoip2-golang"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -15,6 +17,72 @@ var (
 	ErrInvalidTunnelData     = errors.New("gatewaysshd: invalid tunnel data")
 )
 
+// permission extensions set by the gateway itself, certificates cannot set these
+const (
+	extensionPrefix    = "gatewaysshd@"
+	extensionPublicKey = "gatewaysshd@public-key"
+	extensionEnroll    = "gatewaysshd@enroll"
+)
+
+// admins are those granted port forwarding by their certificate
+func isAdmin(permissions *ssh.Permissions) bool {
+	if permissions == nil {
+		return false
+	}
+	_, ok := permissions.Extensions["permit-port-forwarding"]
+	return ok
+}
+
+// connections logged in as the enroll user can only enroll their key
+func isEnrolling(permissions *ssh.Permissions) bool {
+	if permissions == nil {
+		return false
+	}
+	_, ok := permissions.Extensions[extensionEnroll]
+	return ok
+}
+
+// copy permissions, replacing extensions reserved for the gateway with the key used to log in
+func sanitizePermissions(permissions *ssh.Permissions, key ssh.PublicKey) *ssh.Permissions {
+	sanitized := &ssh.Permissions{
+		CriticalOptions: permissions.CriticalOptions,
+		Extensions:      make(map[string]string),
+	}
+	for name, value := range permissions.Extensions {
+		if !strings.HasPrefix(name, extensionPrefix) {
+			sanitized.Extensions[name] = value
+		}
+	}
+	sanitized.Extensions[extensionPublicKey] = string(ssh.MarshalAuthorizedKey(key))
+	return sanitized
+}
+
+// the key used to log in, as recorded by sanitizePermissions
+func permittedPublicKey(permissions *ssh.Permissions) ssh.PublicKey {
+	if permissions == nil {
+		return nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(permissions.Extensions[extensionPublicKey]))
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// connection metadata for authenticating a public key outside of a ssh handshake,
+// where there is no local address of a ssh listener
+type keyMetadata struct {
+	user       string
+	remoteAddr net.Addr
+}
+
+func (m *keyMetadata) User() string          { return m.user }
+func (m *keyMetadata) SessionID() []byte     { return nil }
+func (m *keyMetadata) ClientVersion() []byte { return nil }
+func (m *keyMetadata) ServerVersion() []byte { return nil }
+func (m *keyMetadata) RemoteAddr() net.Addr  { return m.remoteAddr }
+func (m *keyMetadata) LocalAddr() net.Addr   { return nil }
+
 type forwardRequest struct {
 	Host string
 	Port uint32
@@ -87,42 +155,56 @@ func unmarshalExecuteRequest(payload []byte) (*executeRequest, error) {
 	return request, nil
 }
 
-func lookupLocation(db string, ip net.IP) map[string]interface{} {
-	d, err := geoip2.Open(db)
-	if err != nil {
-		log.Warningf("failed to open geoip database file %s: %s", db, err)
-		return nil
-	}
-	defer d.Close()
+type disconnectRequest struct {
+	Reason string
+}
 
-	r, err := d.City(ip)
-	if err != nil {
-		return nil
-	}
+func marshalDisconnectRequest(request *disconnectRequest) []byte {
+	return ssh.Marshal(request)
+}
 
-	if r.Country.IsoCode == "" {
-		return nil
-	}
+type shutdownRequest struct {
+	Timeout uint32
+}
 
-	if r.Location.Latitude == 0 && r.Location.Longitude == 0 {
-		return nil
-	}
+func marshalShutdownRequest(request *shutdownRequest) []byte {
+	return ssh.Marshal(request)
+}
 
-	location := map[string]interface{}{
-		"country":   r.Country.IsoCode,
-		"latitude":  r.Location.Latitude,
-		"longitude": r.Location.Longitude,
-	}
-	if r.City.Names["en"] != "" {
-		location["city"] = r.City.Names["en"]
-	}
-	if r.Location.TimeZone != "" {
-		location["timezone"] = r.Location.TimeZone
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+func unmarshalPtyRequest(payload []byte) (*ptyRequest, error) {
+	request := &ptyRequest{}
+
+	if err := ssh.Unmarshal(payload, request); err != nil {
+		return nil, err
 	}
-	if len(r.Subdivisions) > 0 && r.Subdivisions[0].Names["en"] != "" {
-		location["subdivision"] = r.Subdivisions[0].Names["en"]
+
+	return request, nil
+}
+
+type windowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+func unmarshalWindowChangeRequest(payload []byte) (*windowChangeRequest, error) {
+	request := &windowChangeRequest{}
+
+	if err := ssh.Unmarshal(payload, request); err != nil {
+		return nil, err
 	}
-	return location
+
+	return request, nil
 }
 
 type usageStats struct {
@@ -214,3 +296,16 @@ func (c *wrappedConn) SetReadDeadline(t time.Time) error {
 func (c *wrappedConn) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
+
+// translates line feeds to carriage return and line feed, as a client with a pty
+// has its terminal in raw mode and does not do this itself
+type crlfWriter struct {
+	writer io.Writer
+}
+
+func (w *crlfWriter) Write(data []byte) (int, error) {
+	if _, err := w.writer.Write(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
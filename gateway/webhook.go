@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrInvalidWebhookURL = errors.New("gatewaysshd: invalid webhook url")
+)
+
+const (
+	webhookDefaultTimeout = 10 * time.Second
+	webhookInitialBackoff = 1 * time.Second
+	webhookMaximumBackoff = 60 * time.Second
+
+	// how long events still queued are delivered for when the gateway is closed
+	webhookFlushTimeout = 10 * time.Second
+)
+
+// settings of an outbound webhook that is notified of gateway events
+type WebhookSettings struct {
+	// where events are posted to
+	URL string
+
+	// glob patterns on event type and user, empty matches all
+	Types []string
+	Users []string
+
+	// when set, the body is signed with hmac-sha256 in the X-Gatewaysshd-Signature header
+	Secret string
+
+	// number of events queued before new events are dropped
+	QueueSize int
+
+	// number of times a failed delivery is retried with exponential backoff
+	MaxRetries int
+
+	// timeout of each delivery attempt
+	Timeout time.Duration
+}
+
+// delivers events to a webhook in the background, one at a time
+type webhook struct {
+	settings     *WebhookSettings
+	client       *http.Client
+	subscription *Subscription
+	ctx          context.Context
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+func newWebhook(settings *WebhookSettings, events *eventBus) (*webhook, error) {
+	if parsed, err := url.Parse(settings.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, ErrInvalidWebhookURL
+	}
+
+	filter, err := NewEventFilter(settings.Types, settings.Users)
+	if err != nil {
+		return nil, err
+	}
+
+	queueSize := settings.QueueSize
+	if queueSize <= 0 {
+		queueSize = eventBufferSize
+	}
+
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = webhookDefaultTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhook{
+		settings: settings,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		subscription: events.subscribeWithBuffer(filter, queueSize),
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	go w.run()
+
+	log.Infof("webhook: started: url = %s, types = %v, users = %v", settings.URL, settings.Types, settings.Users)
+	return w, nil
+}
+
+// stop receiving events and deliver those still in the queue, events not delivered
+// before the timeout are discarded
+func (w *webhook) Close(timeout time.Duration) {
+	w.subscription.Close()
+
+	select {
+	case <-w.done:
+		return
+	case <-time.After(timeout):
+	}
+	log.Warningf("webhook: discarding undelivered events after %s: url = %s", timeout, w.settings.URL)
+	w.cancel()
+	<-w.done
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	defer w.cancel()
+
+	for event := range w.subscription.Events() {
+		if w.ctx.Err() != nil {
+			return
+		}
+
+		if dropped := w.subscription.TakeDropped(); dropped > 0 {
+			log.Warningf("webhook: queue full, dropped %d events: url = %s", dropped, w.settings.URL)
+			w.deliver(newDroppedEvent(dropped))
+		}
+		w.deliver(event)
+	}
+}
+
+// deliver an event, retrying with exponential backoff
+func (w *webhook) deliver(event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("webhook: failed to encode event: %s", err)
+		return
+	}
+
+	backoff := webhookInitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(event, body)
+		if err == nil {
+			log.Debugf("webhook: delivered: url = %s, type = %s, attempt = %d", w.settings.URL, event.Type, attempt)
+			return
+		}
+		if attempt >= w.settings.MaxRetries {
+			log.Errorf("webhook: giving up after %d attempts: url = %s, type = %s, error = %s", attempt+1, w.settings.URL, event.Type, err)
+			return
+		}
+		log.Warningf("webhook: delivery failed, retrying in %s: url = %s, type = %s, error = %s", backoff, w.settings.URL, event.Type, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > webhookMaximumBackoff {
+			backoff = webhookMaximumBackoff
+		}
+	}
+}
+
+func (w *webhook) post(event *Event, body []byte) error {
+	request, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.settings.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	request.Header.Set("User-Agent", "gatewaysshd")
+	request.Header.Set("X-Gatewaysshd-Event", event.Type)
+	if w.settings.Secret != "" {
+		request.Header.Set("X-Gatewaysshd-Signature", "sha256="+signWebhookBody(w.settings.Secret, body))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	return nil
+}
+
+// hex encoded hmac-sha256 of the body, receivers should compute the same to verify
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a request received by the test receiver
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	event  *Event
+}
+
+// starts a receiver that answers with the status returned by the callback for each request,
+// and sends every request it receives to the returned channel
+func newWebhookReceiver(t *testing.T, status func(attempt int) int) (*httptest.Server, <-chan *webhookRequest) {
+	requests := make(chan *webhookRequest, 16)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid event: %s", err)
+		}
+		requests <- &webhookRequest{
+			header: request.Header,
+			body:   body,
+			event:  &event,
+		}
+		response.WriteHeader(status(int(atomic.AddInt32(&attempts, 1))))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func receiveWebhook(t *testing.T, requests <-chan *webhookRequest, timeout time.Duration) *webhookRequest {
+	select {
+	case request := <-requests:
+		return request
+	case <-time.After(timeout):
+		t.Fatal("no webhook request received")
+		return nil
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	server, requests := newWebhookReceiver(t, func(int) int { return http.StatusNoContent })
+	events := newEventBus()
+	webhook, err := newWebhook(&WebhookSettings{
+		URL:    server.URL,
+		Secret: "s3cr3t",
+	}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhook.Close(time.Second)
+
+	events.publish(&Event{
+		Type:      EventConnectionOpened,
+		Timestamp: 1,
+		User:      "device",
+	})
+
+	request := receiveWebhook(t, requests, time.Second)
+	if request.event.Type != EventConnectionOpened || request.event.User != "device" {
+		t.Fatalf("unexpected event: %+v", request.event)
+	}
+	if request.header.Get("X-Gatewaysshd-Event") != EventConnectionOpened {
+		t.Fatalf("unexpected event header: %s", request.header.Get("X-Gatewaysshd-Event"))
+	}
+	if signature := request.header.Get("X-Gatewaysshd-Signature"); signature != "sha256="+signWebhookBody("s3cr3t", request.body) {
+		t.Fatalf("unexpected signature: %s", signature)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	server, requests := newWebhookReceiver(t, func(attempt int) int {
+		if attempt == 1 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	events := newEventBus()
+	webhook, err := newWebhook(&WebhookSettings{
+		URL:        server.URL,
+		MaxRetries: 1,
+	}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhook.Close(time.Second)
+
+	events.publish(&Event{
+		Type: EventConnectionClosed,
+		User: "device",
+	})
+
+	first := receiveWebhook(t, requests, time.Second)
+	second := receiveWebhook(t, requests, webhookInitialBackoff+time.Second)
+	if first.event.Type != EventConnectionClosed || second.event.Type != EventConnectionClosed {
+		t.Fatalf("unexpected events: %+v, %+v", first.event, second.event)
+	}
+}
+
+func TestWebhookFilter(t *testing.T) {
+	server, requests := newWebhookReceiver(t, func(int) int { return http.StatusOK })
+	events := newEventBus()
+	webhook, err := newWebhook(&WebhookSettings{
+		URL:   server.URL,
+		Types: []string{"connection.*"},
+		Users: []string{"device-*"},
+	}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhook.Close(time.Second)
+
+	events.publish(&Event{Type: EventTunnelOpened, User: "device-1"})
+	events.publish(&Event{Type: EventConnectionOpened, User: "workstation"})
+	events.publish(&Event{Type: EventConnectionOpened, User: "device-1"})
+
+	request := receiveWebhook(t, requests, time.Second)
+	if request.event.Type != EventConnectionOpened || request.event.User != "device-1" {
+		t.Fatalf("unexpected event: %+v", request.event)
+	}
+	select {
+	case request := <-requests:
+		t.Fatalf("filtered event delivered: %+v", request.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookCloseDeliversQueuedEvents(t *testing.T) {
+	server, requests := newWebhookReceiver(t, func(int) int { return http.StatusOK })
+	events := newEventBus()
+	webhook, err := newWebhook(&WebhookSettings{
+		URL: server.URL,
+	}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		events.publish(&Event{Type: EventConnectionClosed, User: "device"})
+	}
+	webhook.Close(time.Second)
+
+	if len(requests) != 5 {
+		t.Fatalf("expected 5 events delivered before close returned, got %d", len(requests))
+	}
+}